@@ -0,0 +1,175 @@
+package mqttinflux
+
+// Conversions for integers in other bases and for binary payloads,
+// e.g. LoRaWAN uplinks which arrive as base64 encoded bytes.
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Hex converts a hexadecimal number, with or without "0x" prefix.
+func Hex(raw string, params *Conversion) (interface{}, error) {
+	return parseBase(raw, 16, "0x", params)
+}
+
+// Octal converts an octal number, with or without "0o" prefix.
+func Octal(raw string, params *Conversion) (interface{}, error) {
+	return parseBase(raw, 8, "0o", params)
+}
+
+// Binary converts a binary number, with or without "0b" prefix.
+func Binary(raw string, params *Conversion) (interface{}, error) {
+	return parseBase(raw, 2, "0b", params)
+}
+
+func parseBase(raw string, base int, prefix string, params *Conversion) (interface{}, error) {
+	s := strings.TrimSpace(raw)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		s = s[len(prefix):]
+	}
+	if negative {
+		s = "-" + s
+	}
+
+	parsed, err := strconv.ParseInt(s, base, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Scale != 0 {
+		parsed = int64(float64(parsed) * params.Scale)
+	}
+	return parsed, nil
+}
+
+// Bit converts an integer (decimal or with "0x" or "0b" prefix)
+// to a boolean which tells if the given `Bit` is set.
+func Bit(raw string, params *Conversion) (interface{}, error) {
+	s := strings.TrimSpace(raw)
+	base := 10
+	if len(s) > 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		}
+	}
+	if base != 10 {
+		s = s[2:]
+	}
+
+	parsed, err := strconv.ParseUint(s, base, 64)
+	if err != nil {
+		return nil, err
+	}
+	return parsed&(1<<uint(params.Bit)) != 0, nil
+}
+
+// Bytes decodes a number from a base64 or hex encoded byte payload.
+// `Offset` and `Length` select the bytes, `ByteOrder` is "big" (default)
+// or "little". Integers are unsigned unless `Signed` is set; with `Float`,
+// 4 or 8 bytes are read as an IEEE 754 number.
+// If a `Scale` is given, the result is a float.
+func Bytes(raw string, params *Conversion) (interface{}, error) {
+	data, err := decodeBytes(strings.TrimSpace(raw), params.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	length := params.Length
+	if length == 0 {
+		length = 1
+	}
+	if params.Offset+length > len(data) {
+		return nil, fmt.Errorf("need %d bytes at offset %d, got %d bytes",
+			length, params.Offset, len(data))
+	}
+	b := data[params.Offset : params.Offset+length]
+
+	// read as big endian, pad to 8 bytes
+	buf := make([]byte, 8)
+	for i := range b {
+		if params.ByteOrder == "little" {
+			buf[7-i] = b[i]
+		} else {
+			buf[8-length+i] = b[i]
+		}
+	}
+	u := binary.BigEndian.Uint64(buf)
+
+	var value interface{}
+	switch {
+	case params.Float && length == 4:
+		value = float64(math.Float32frombits(uint32(u)))
+	case params.Float:
+		value = math.Float64frombits(u)
+	case params.Signed:
+		// sign extension
+		shift := uint(64 - 8*length)
+		value = int64(u<<shift) >> shift
+	case u > math.MaxInt64:
+		value = u
+	default:
+		value = int64(u)
+	}
+
+	if params.Scale != 0 {
+		switch v := value.(type) {
+		case int64:
+			return float64(v) * params.Scale, nil
+		case uint64:
+			return float64(v) * params.Scale, nil
+		case float64:
+			return v * params.Scale, nil
+		}
+	}
+	return value, nil
+}
+
+func decodeBytes(s, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "base64":
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(s)
+		}
+		return data, err
+	case "hex":
+		return hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X"))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// validateBytes checks the parameters for the "bytes" conversion.
+func validateBytes(c *Conversion) error {
+	switch c.Encoding {
+	case "", "base64", "hex":
+	default:
+		return fmt.Errorf("unsupported encoding %q", c.Encoding)
+	}
+	switch c.ByteOrder {
+	case "", "big", "little":
+	default:
+		return fmt.Errorf("unsupported byte order %q", c.ByteOrder)
+	}
+	if c.Offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	if c.Length < 0 || c.Length > 8 {
+		return fmt.Errorf("invalid length %d, must be 1 to 8 bytes", c.Length)
+	}
+	if c.Float && c.Length != 4 && c.Length != 8 {
+		return fmt.Errorf("invalid length %d for float, must be 4 or 8 bytes", c.Length)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package mqttinflux
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestConvertBase(t *testing.T) {
+	c := Conversion{Kind: "hex"}
+	checkConversion(c, map[string]interface{}{
+		"0x1F": int64(31),
+		"1f":   int64(31),
+		"-0xA": int64(-10),
+		"FFFF": int64(65535),
+	}, t)
+	checkExpectedErrors(c, []string{"", "0x", "0xG1", "1.5"}, t)
+
+	c = Conversion{Kind: "octal"}
+	checkConversion(c, map[string]interface{}{"0o17": int64(15), "755": int64(493)}, t)
+	checkExpectedErrors(c, []string{"8", "0x1"}, t)
+
+	c = Conversion{Kind: "binary", Scale: 0.5}
+	checkConversion(c, map[string]interface{}{"0b1010": int64(5), "11": int64(1)}, t)
+	checkExpectedErrors(c, []string{"2", "0b"}, t)
+}
+
+func TestConvertBit(t *testing.T) {
+	c := Conversion{Kind: "bit", Bit: 2}
+	checkConversion(c, map[string]interface{}{
+		"4":      true,
+		"3":      false,
+		"0x0C":   true,
+		"0b1011": false,
+		"010":    false,
+		"0004":   true,
+	}, t)
+	checkExpectedErrors(c, []string{"", "-1", "foo", "0x", "0o7", "0b12"}, t)
+}
+
+func TestConvertBytes(t *testing.T) {
+	payload := base64.StdEncoding.EncodeToString([]byte{0x01, 0xFF, 0xFE, 0x41, 0xAC, 0x00, 0x00})
+
+	cases := []struct {
+		c        Conversion
+		expected interface{}
+	}{
+		{Conversion{}, int64(1)},
+		{Conversion{Offset: 1, Length: 2}, int64(65534)},
+		{Conversion{Offset: 1, Length: 2, Signed: true}, int64(-2)},
+		{Conversion{Offset: 1, Length: 2, ByteOrder: "little"}, int64(65279)},
+		{Conversion{Offset: 1, Length: 2, Signed: true, Scale: 0.5}, -1.0},
+		{Conversion{Offset: 3, Length: 4, Float: true}, 21.5},
+	}
+
+	for _, c := range cases {
+		conversion := c.c
+		conversion.Kind = "bytes"
+		result, err := conversion.Convert(payload)
+		if err != nil {
+			t.Errorf("%+v: %v", conversion, err)
+		} else if result != c.expected {
+			t.Errorf("%+v: expected %v, got %v", conversion, c.expected, result)
+		}
+	}
+
+	c := Conversion{Kind: "bytes", Encoding: "hex", Length: 8}
+	checkConversion(c, map[string]interface{}{"FFFFFFFFFFFFFFFF": uint64(18446744073709551615)}, t)
+	c = Conversion{Kind: "bytes", Encoding: "hex", Length: 2}
+	checkConversion(c, map[string]interface{}{"0x0102": int64(258)}, t)
+	checkExpectedErrors(c, []string{"01", "0G01"}, t)
+	checkExpectedErrors(Conversion{Kind: "bytes"}, []string{"!!!"}, t)
+
+	invalid := []Conversion{
+		{Kind: "bytes", Encoding: "ascii85"},
+		{Kind: "bytes", ByteOrder: "middle"},
+		{Kind: "bytes", Offset: -1},
+		{Kind: "bytes", Length: 9},
+		{Kind: "bytes", Length: 2, Float: true},
+		{Kind: "bit", Bit: 64},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", c)
+		}
+	}
+}
+
+func TestBytesFields(t *testing.T) {
+	s := &Subscription{
+		Measurement: "uplink",
+		Value:       `JSON "data"`,
+		Conversion:  Conversion{Kind: "bytes", Offset: 0, Length: 2, Signed: true, Scale: 0.1},
+		Fields: map[string]Field{
+			"battery": {
+				Value:      `JSON "data"`,
+				Conversion: Conversion{Kind: "bytes", Offset: 2},
+			},
+			"alarm": {
+				Value: `JSON "data"`,
+				Conversion: Conversion{Steps: []Conversion{
+					{Kind: "bytes", Offset: 3},
+					{Kind: "bit", Bit: 0},
+				}},
+			},
+		},
+	}
+
+	data := base64.StdEncoding.EncodeToString([]byte{0x00, 0xD7, 0x5A, 0x01})
+	m, err := s.Read("lora/device", `{"data": "`+data+`"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if v, _ := m.Values["value"].(float64); v < 21.49 || v > 21.51 {
+		t.Errorf("Expected 21.5, got %v", m.Values["value"])
+	}
+	if m.Values["battery"] != int64(90) {
+		t.Errorf("Expected 90, got %v", m.Values["battery"])
+	}
+	if m.Values["alarm"] != true {
+		t.Errorf("Expected true, got %v", m.Values["alarm"])
+	}
+}
@@ -172,21 +172,38 @@ func readSetup(configPath string) (Config, []Subscription, error) {
 	}
 
 	subs, err := readSubscriptions()
+	if err != nil {
+		return config, subs, err
+	}
 
-	return config, subs, err
+	if config.Homie {
+		logHomieEnabled(config.HomieBaseTopic)
+		homie := homieSubscription(config.HomieBaseTopic)
+		// parse before the subscription is copied,
+		// so that all copies share the learned metadata
+		err = homie.parseTemplates()
+		if err != nil {
+			return config, subs, err
+		}
+		subs = append(subs, homie)
+	}
+
+	return config, subs, nil
 }
 
 func readConfig(configPath string) (Config, error) {
 	// init with defaults
 	config := Config{
-		PidFile:    "",
-		MQTTHost:   "localhost",
-		MQTTPort:   1883,
-		InfluxHost: "localhost",
-		InfluxPort: 8086,
-		InfluxDB:   "default",
-		InfluxUser: "",
-		InfluxPass: "",
+		PidFile:             "",
+		MQTTHost:            "localhost",
+		MQTTPort:            1883,
+		InfluxHost:          "localhost",
+		InfluxPort:          8086,
+		InfluxDB:            "default",
+		InfluxUser:          "",
+		InfluxPass:          "",
+		HomieBaseTopic:      "homie",
+		HomeAssistantPrefix: "homeassistant",
 	}
 
 	var paths []string
@@ -233,7 +250,123 @@ func readConfig(configPath string) (Config, error) {
 	if required && !found {
 		return config, fmt.Errorf("failed to read configuration %q", configPath)
 	}
-	return config, nil
+
+	err := applyOverrides(&config)
+	return config, err
+}
+
+// prefix for environment variables which override configuration keys
+const envPrefix = "MFX_"
+
+// configOverride describes how a single configuration key can be set
+// from a secret file or from the environment.
+type configOverride struct {
+	key  string
+	file string // path from the `<key>File` setting, if any
+	set  func(value string) error
+}
+
+func configOverrides(config *Config) []configOverride {
+	return []configOverride{
+		{"pidfile", "", setString(&config.PidFile)},
+		{"MQTTHost", "", setString(&config.MQTTHost)},
+		{"MQTTPort", "", setInt(&config.MQTTPort)},
+		{"MQTTUser", config.MQTTUserFile, setString(&config.MQTTUser)},
+		{"MQTTPass", config.MQTTPassFile, setString(&config.MQTTPass)},
+		{"influxHost", "", setString(&config.InfluxHost)},
+		{"influxPort", "", setInt(&config.InfluxPort)},
+		{"influxUser", config.InfluxUserFile, setString(&config.InfluxUser)},
+		{"influxPass", config.InfluxPassFile, setString(&config.InfluxPass)},
+		{"influxDB", "", setString(&config.InfluxDB)},
+		{"homie", "", setBool(&config.Homie)},
+		{"homieBaseTopic", "", setString(&config.HomieBaseTopic)},
+		{"homeAssistant", "", setBool(&config.HomeAssistant)},
+		{"homeAssistantPrefix", "", setString(&config.HomeAssistantPrefix)},
+	}
+}
+
+// applyOverrides sets configuration values from secret files and environment
+// variables. In order of precedence (highest first):
+//
+//  1. MFX_<KEY>_FILE, read the value from the given file
+//  2. MFX_<KEY>, the value of the environment variable
+//  3. <key>File from the config file, read the value from the given file
+//  4. <key> from the config file
+//
+// <KEY> is the configuration key in upper case, e.g. `MFX_INFLUXPASS`.
+func applyOverrides(config *Config) error {
+	for _, o := range configOverrides(config) {
+		if o.file != "" {
+			err := o.setFromFile(o.file)
+			if err != nil {
+				return err
+			}
+			logConfigFromFile(o.key, o.file)
+		}
+
+		name := envPrefix + strings.ToUpper(o.key)
+		if value, ok := os.LookupEnv(name); ok {
+			err := o.set(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %v: %v", name, err)
+			}
+			logConfigFromEnv(o.key, name)
+		}
+
+		if path, ok := os.LookupEnv(name + "_FILE"); ok {
+			err := o.setFromFile(path)
+			if err != nil {
+				return err
+			}
+			logConfigFromFile(o.key, path)
+		}
+	}
+
+	return nil
+}
+
+func (o configOverride) setFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// secret files usually end with a newline
+	value := strings.TrimRight(string(data), "\r\n")
+	err = o.set(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %v in %q: %v", o.key, path, err)
+	}
+	return nil
+}
+
+func setString(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+func setBool(target *bool) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		*target = parsed
+		return nil
+	}
+}
+
+func setInt(target *int) func(string) error {
+	return func(value string) error {
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		*target = parsed
+		return nil
+	}
 }
 
 func readSubscriptions() ([]Subscription, error) {
@@ -288,6 +421,14 @@ func readSubscriptionFile(path string) ([]Subscription, error) {
 		}
 	}
 
+	// fail on startup instead of with the first message
+	for i := range subs {
+		err := subs[i].parseTemplates()
+		if err != nil {
+			return subs, fmt.Errorf("invalid subscription %q in %v: %v", subs[i].Topic, path, err)
+		}
+	}
+
 	logReadSubs(subs, path)
 	return subs, nil
 }
@@ -310,6 +451,18 @@ func logNoConfig(path string) {
 	LogInfo("Controller no config found at '%v'", path)
 }
 
+func logHomieEnabled(baseTopic string) {
+	LogInfo("Controller Homie auto-discovery enabled for %q", baseTopic)
+}
+
+func logConfigFromEnv(key, name string) {
+	LogInfo("Controller config %q set from environment %v", key, name)
+}
+
+func logConfigFromFile(key, path string) {
+	LogInfo("Controller config %q read from file %q", key, path)
+}
+
 func logPIDWritten(pid int, path string) {
 	LogInfo("Controller PID %v written to %q", pid, path)
 }
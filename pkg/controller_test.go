@@ -0,0 +1,95 @@
+package mqttinflux
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigOverrides(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	err := os.WriteFile(secret, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		MQTTHost:       "localhost",
+		MQTTPort:       1883,
+		InfluxPass:     "plain",
+		InfluxPassFile: secret,
+		MQTTPass:       "plain",
+	}
+
+	setenv(t, "MFX_MQTTHOST", "broker")
+	setenv(t, "MFX_MQTTPORT", "8883")
+	setenv(t, "MFX_MQTTPASS_FILE", secret)
+
+	err = applyOverrides(&config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.MQTTHost != "broker" {
+		t.Errorf("Expected MQTTHost from env, got %q", config.MQTTHost)
+	}
+	if config.MQTTPort != 8883 {
+		t.Errorf("Expected MQTTPort from env, got %v", config.MQTTPort)
+	}
+	if config.InfluxPass != "from-file" {
+		t.Errorf("Expected influxPass from file, got %q", config.InfluxPass)
+	}
+	if config.MQTTPass != "from-file" {
+		t.Errorf("Expected MQTTPass from file, got %q", config.MQTTPass)
+	}
+
+	// env takes precedence over <key>File
+	setenv(t, "MFX_INFLUXPASS", "from-env")
+	err = applyOverrides(&config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.InfluxPass != "from-env" {
+		t.Errorf("Expected influxPass from env, got %q", config.InfluxPass)
+	}
+}
+
+func TestConfigOverridesInvalid(t *testing.T) {
+	setenv(t, "MFX_INFLUXPORT", "not a number")
+	config := Config{}
+	err := applyOverrides(&config)
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+
+	os.Unsetenv("MFX_INFLUXPORT")
+	config.InfluxPassFile = filepath.Join(t.TempDir(), "does-not-exist")
+	err = applyOverrides(&config)
+	if err == nil {
+		t.Error("Expected error for missing secret file, got OK")
+	}
+}
+
+func setenv(t *testing.T, name, value string) {
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		os.Unsetenv(name)
+	})
+}
+
+func TestReadSubscriptionFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subs.json")
+	err := os.WriteFile(path, []byte(`[
+		{"topic": "ok", "measurement": "m"},
+		{"topic": "bad", "measurement": "m", "when": "JSON \"type\" == "}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readSubscriptionFile(path)
+	if err == nil {
+		t.Errorf("Expected error for invalid subscription, got OK")
+	}
+}
@@ -1,37 +1,31 @@
 package mqttinflux
 
-// format for field values by data type:
-// - https://golang.org/pkg/fmt/
-// - https://docs.influxdata.com/influxdb/v1.3//write_protocols/line_protocol_tutorial/#syntax
+// Converters read the raw value from an MQTT message and return a typed
+// field value:
 //
-// float:
-//    any numerical value, with or without decimal separator
+// float:   float64 (also for expressions)
+// integer: int64
+// unsigned: uint64
+// boolean: bool
+// string:  string
 //
-// integer:
-//    numerical value, no decimal separator, APPEND 'i' - e.g. 123i
-//
-//	  Go: %d, base 10 integer, add the 'i'
-//
-// boolean:
-//    true: t, T, true, True, TRUE
-//    false: f, F, false, False, FALSE
-//
-//	  Go: %t -> true|false
-//
-// string:
-//    double quote, e.g. "foo" or "foo bar"
-//    escape quotes within the string: "foo \"bar\" baz"
-//
-//    Go: %q, double quotes incl. escape
+// The line protocol representation is created when the measurement
+// is sent to InfluxDB, see `formatFieldValue`.
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Converter is the type for a converter function.
-type Converter func(raw string, params *Conversion) (string, error)
+// It returns a typed field value (float64, int64, uint64, bool or string).
+type Converter func(raw string, params *Conversion) (interface{}, error)
 
 var converters map[string]Converter
 
@@ -40,27 +34,197 @@ func init() {
 	converters["identity"] = Identity
 	converters["float"] = Float
 	converters["integer"] = Integer
+	converters["unsigned"] = Unsigned
 	converters["string"] = String
+	converters["expression"] = Expression
+	converters["unit"] = Unit
+	converters["regex"] = Regex
+	converters["hex"] = Hex
+	converters["octal"] = Octal
+	converters["binary"] = Binary
+	converters["bit"] = Bit
+	converters["bytes"] = Bytes
+	converters["duration"] = Duration
+	converters["datetime"] = Datetime
+	converters["rate"] = Counter
+	converters["delta"] = Counter
 	converters["boolean"] = Boolean
 	converters["on-off"] = OnOff
 }
 
 // Conversion parameters
+//
+// Expression: an arithmetic expression for the "expression" kind
+// From, To: units for the "unit" and "duration" kinds,
+// To is also the precision of the "datetime" kind and the time unit
+// for the "rate" kind
+// UnitTag: optional, a tag for the target unit of the "unit" kind
+// Pattern, Group, Replace: regular expression, capture group and optional
+// replacement for the "regex" kind
+// Encoding, Offset, Length, ByteOrder, Signed, Float: how to decode
+// a number with the "bytes" kind
+// Bit: the bit for the "bit" kind
+// Lookup: translate the value before it is converted, keys are values
+// or numeric ranges like "0-20"
+// Default, PassThrough, IgnoreCase: how to treat values which are not
+// found in the Lookup
+// Layout, Timezone: how to parse a time with the "datetime" kind
+// Integer: round the result of the "duration" kind to an integer
+// Wrap: the value at which the counter for "rate" and "delta" wraps around
+// Steps: a chain of conversions, the output of each step is the input
+// for the next. In JSON, steps are given as an array instead of an object.
 type Conversion struct {
-	Kind      string            `json:"kind"`
-	Precision int               `json:"precision"`
-	Scale     float64           `json:"scale"`
-	Lookup    map[string]string `json:"lookup"`
+	Kind        string            `json:"kind"`
+	Precision   int               `json:"precision"`
+	Scale       float64           `json:"scale"`
+	Lookup      map[string]string `json:"lookup"`
+	Default     *string           `json:"default"`
+	PassThrough bool              `json:"passThrough"`
+	IgnoreCase  bool              `json:"ignoreCase"`
+	Expression  string            `json:"expression"`
+	From        string            `json:"from"`
+	To          string            `json:"to"`
+	UnitTag     string            `json:"unitTag"`
+	Pattern     string            `json:"pattern"`
+	Group       int               `json:"group"`
+	Replace     *string           `json:"replace"`
+	Encoding    string            `json:"encoding"`
+	Offset      int               `json:"offset"`
+	Length      int               `json:"length"`
+	ByteOrder   string            `json:"byteOrder"`
+	Signed      bool              `json:"signed"`
+	Float       bool              `json:"float"`
+	Bit         int               `json:"bit"`
+	Layout      string            `json:"layout"`
+	Timezone    string            `json:"timezone"`
+	Integer     bool              `json:"integer"`
+	Wrap        float64           `json:"wrap"`
+	Steps       []Conversion      `json:"-"`
+	ctx         *TemplateContext
+}
+
+// UnmarshalJSON reads either a single conversion (an object)
+// or a list of steps (an array).
+func (c *Conversion) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var steps []Conversion
+		err := json.Unmarshal(data, &steps)
+		if err != nil {
+			return err
+		}
+		*c = Conversion{Steps: steps}
+		return nil
+	}
+
+	// alias type without the UnmarshalJSON method
+	type plain Conversion
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// withContext returns a copy of the conversion which can access
+// values from the message, e.g. in expressions.
+func (c Conversion) withContext(ctx TemplateContext) *Conversion {
+	c.ctx = &ctx
+	return &c
+}
+
+// validate checks the parameters of the conversion and its steps.
+func (c *Conversion) validate() error {
+	if c.Lookup != nil {
+		err := validateLookup(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch c.Kind {
+	case "expression":
+		_, err := cachedExpr(c.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression %q: %v", c.Expression, err)
+		}
+	case "regex":
+		pattern, err := cachedRegexp(c.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", c.Pattern, err)
+		}
+		if c.Group < 0 || c.Group > pattern.NumSubexp() {
+			return fmt.Errorf("no group %d in pattern %q", c.Group, c.Pattern)
+		}
+	case "bytes":
+		err := validateBytes(c)
+		if err != nil {
+			return err
+		}
+	case "bit":
+		if c.Bit < 0 || c.Bit > 63 {
+			return fmt.Errorf("invalid bit %d", c.Bit)
+		}
+	case "duration":
+		err := validateDuration(c)
+		if err != nil {
+			return err
+		}
+	case "datetime":
+		_, _, _, err := c.datetimeParams()
+		if err != nil {
+			return err
+		}
+	case "rate", "delta":
+		err := validateCounter(c)
+		if err != nil {
+			return err
+		}
+	case "unit":
+		err := validateUnits(c.From, c.To)
+		if err != nil {
+			return err
+		}
+		if c.UnitTag != "" && !tagPattern.MatchString(c.UnitTag) {
+			return fmt.Errorf("invalid unit tag %q", c.UnitTag)
+		}
+	}
+	err := validateCounterSteps(c)
+	if err != nil {
+		return err
+	}
+	for i := range c.Steps {
+		err := c.Steps[i].validate()
+		if err != nil {
+			return fmt.Errorf("conversion step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// addTags adds the tags for the conversion and its steps to a Measurement,
+// i.e. the `UnitTag`.
+func (c *Conversion) addTags(m *Measurement) {
+	if c.Kind == "unit" && c.UnitTag != "" {
+		m.Tag(c.UnitTag, unitTag(c.To))
+	}
+	for i := range c.Steps {
+		c.Steps[i].addTags(m)
+	}
+}
+
+// configured tells if a conversion kind or steps are set.
+func (c *Conversion) configured() bool {
+	return c.Kind != "" || len(c.Steps) != 0
 }
 
 // Convert applies the conversion to the given `raw` string value.
-func (c *Conversion) Convert(raw string) (string, error) {
+func (c *Conversion) Convert(raw string) (interface{}, error) {
+	if len(c.Steps) != 0 {
+		return c.convertSteps(raw)
+	}
+
 	var err error
 
 	if c.Lookup != nil {
 		raw, err = c.translate(raw)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
@@ -70,31 +234,46 @@ func (c *Conversion) Convert(raw string) (string, error) {
 	}
 	conv, ok := converters[key]
 	if !ok {
-		return "", fmt.Errorf("conversion %q not supported", key)
+		return nil, fmt.Errorf("conversion %q not supported", key)
 	}
 	return conv(raw, c)
 }
 
-// translate applies the Lookup map to the value
-func (c *Conversion) translate(raw string) (string, error) {
-	key := strings.TrimSpace(raw)
-	translated, found := c.Lookup[key]
-	if !found {
-		return "", fmt.Errorf("lookup failed for %q", key)
+// convertSteps applies each step to the output of the previous step.
+func (c *Conversion) convertSteps(raw string) (interface{}, error) {
+	var value interface{} = raw
+	for i := range c.Steps {
+		step := c.Steps[i]
+		step.ctx = c.ctx
+		var err error
+		value, err = step.Convert(formatDecoded(value))
+		if err != nil {
+			kind := step.Kind
+			if kind == "" {
+				kind = "identity"
+			}
+			return nil, fmt.Errorf("conversion step %d (%v): %v", i+1, kind, err)
+		}
 	}
-	return translated, nil
+	return value, nil
 }
 
-// Identity is a `Convert` function which returns its input 1:1.
-func Identity(raw string, params *Conversion) (string, error) {
-	return raw, nil
+// Identity is a `Convert` function which reads a field value
+// in line protocol format, e.g. `1.5`, `12i` or `"foo"`.
+// Anything else is returned as a string.
+func Identity(raw string, params *Conversion) (interface{}, error) {
+	value, err := parseFieldValue(strings.TrimSpace(raw))
+	if err != nil {
+		return raw, nil
+	}
+	return value, nil
 }
 
 // Float attempts to convert string input to a float value.
-func Float(raw string, params *Conversion) (string, error) {
+func Float(raw string, params *Conversion) (interface{}, error) {
 	parsed, err := strconv.ParseFloat(raw, 64)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// special case '-0.0' to '0.0'
@@ -106,18 +285,106 @@ func Float(raw string, params *Conversion) (string, error) {
 		parsed = parsed * params.Scale
 	}
 
-	template := "%f"
 	if params.Precision != 0 {
-		template = fmt.Sprintf("%%.%df", params.Precision)
+		parsed = roundPrecision(parsed, params.Precision)
+	}
+	return parsed, nil
+}
+
+// roundPrecision rounds `x` to the given number of decimal places.
+func roundPrecision(x float64, precision int) float64 {
+	factor := math.Pow(10, float64(precision))
+	return math.Round(x*factor) / factor
+}
+
+// Expression evaluates an arithmetic expression.
+// The raw value is available as `value`, other values from the message
+// can be used like in conditions, e.g. `JSON "voltage" * JSON "current"`.
+// Numeric results are rounded to the given precision.
+func Expression(raw string, params *Conversion) (interface{}, error) {
+	node, err := cachedExpr(params.Expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var ctx TemplateContext
+	if params.ctx != nil {
+		ctx = *params.ctx
+	}
+	ctx.value = &raw
+
+	result, err := node.eval(&ctx)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := result.(bool); ok {
+		return b, nil
+	}
+	f, ok := toNumber(result)
+	if !ok {
+		return nil, fmt.Errorf("expression result is not a number: %q", toString(result))
+	}
+
+	if params.Precision != 0 {
+		f = roundPrecision(f, params.Precision)
+	}
+	return f, nil
+}
+
+// compiled patterns for regex conversions
+var (
+	regexpCache      = make(map[string]*regexp.Regexp)
+	regexpCacheMutex sync.Mutex
+)
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpCacheMutex.Lock()
+	defer regexpCacheMutex.Unlock()
+
+	if re, ok := regexpCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache[pattern] = re
+	return re, nil
+}
+
+// Regex extracts a string from the input with a regular expression.
+// The result is the capture group given in `Group`, by default the first
+// group or the whole match if the pattern has no groups.
+// With `Replace`, all matches are replaced instead, `$1` refers to a group.
+func Regex(raw string, params *Conversion) (interface{}, error) {
+	re, err := cachedRegexp(params.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Replace != nil {
+		return re.ReplaceAllString(raw, *params.Replace), nil
+	}
+
+	groups := re.FindStringSubmatch(raw)
+	if groups == nil {
+		return nil, fmt.Errorf("no match for %q in %q", params.Pattern, raw)
+	}
+	group := params.Group
+	if group == 0 && len(groups) > 1 {
+		group = 1
+	}
+	if group >= len(groups) {
+		return nil, fmt.Errorf("no group %d in pattern %q", group, params.Pattern)
 	}
-	return fmt.Sprintf(template, parsed), nil
+	return groups[group], nil
 }
 
 // Integer converts input to a base 10 integer
-func Integer(raw string, params *Conversion) (string, error) {
+func Integer(raw string, params *Conversion) (interface{}, error) {
 	parsed, err := strconv.ParseInt(raw, 10, 64)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if params.Scale != 0 {
@@ -125,28 +392,58 @@ func Integer(raw string, params *Conversion) (string, error) {
 		parsed = int64(scaled)
 	}
 
-	return fmt.Sprintf("%di", parsed), nil
+	return parsed, nil
 }
 
-// String converts to a quoted string.
-func String(raw string, params *Conversion) (string, error) {
-	return fmt.Sprintf("%q", raw), nil
+// Unsigned converts input to a base 10 unsigned integer.
+// Negative values are rejected.
+func Unsigned(raw string, params *Conversion) (interface{}, error) {
+	s := strings.TrimSpace(raw)
+	if strings.HasPrefix(s, "-") {
+		return nil, fmt.Errorf("negative value %q for unsigned integer", raw)
+	}
+	parsed, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Scale != 0 {
+		// integer scales are applied without rounding to float
+		if factor := uint64(params.Scale); params.Scale > 0 && float64(factor) == params.Scale {
+			if parsed > math.MaxUint64/factor {
+				return nil, fmt.Errorf("scaled value of %v out of range for unsigned integer", parsed)
+			}
+			return parsed * factor, nil
+		}
+		scaled := float64(parsed) * params.Scale
+		if scaled < 0 || scaled >= math.MaxUint64 {
+			return nil, fmt.Errorf("scaled value %v out of range for unsigned integer", scaled)
+		}
+		parsed = uint64(scaled)
+	}
+
+	return parsed, nil
+}
+
+// String converts to a string value.
+func String(raw string, params *Conversion) (interface{}, error) {
+	return raw, nil
 }
 
 // Boolean converts to a boolean value.
-func Boolean(raw string, params *Conversion) (string, error) {
+func Boolean(raw string, params *Conversion) (interface{}, error) {
 	s := strings.TrimSpace(strings.ToLower(raw))
 	parsed, err := strconv.ParseBool(s)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return fmt.Sprintf("%t", parsed), nil
+	return parsed, nil
 }
 
 // OnOff converts the string "on" or "off" to a boolean value
 // on=true, off=false
 // case-insensitive
-func OnOff(raw string, params *Conversion) (string, error) {
+func OnOff(raw string, params *Conversion) (interface{}, error) {
 	s := strings.TrimSpace(strings.ToLower(raw))
 	var value bool
 	if s == "on" {
@@ -154,7 +451,7 @@ func OnOff(raw string, params *Conversion) (string, error) {
 	} else if s == "off" {
 		value = false
 	} else {
-		return "", fmt.Errorf("expected on/off, got %q", raw)
+		return nil, fmt.Errorf("expected on/off, got %q", raw)
 	}
-	return fmt.Sprintf("%t", value), nil
+	return value, nil
 }
@@ -1,34 +1,38 @@
 package mqttinflux
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestConvertIdentity(t *testing.T) {
-	c := new(Conversion)
+	c := Conversion{}
+	cases := make(map[string]interface{}, 6)
+	cases["foo"] = "foo"
+	cases["1.5"] = 1.5
+	cases["12i"] = int64(12)
+	cases["12u"] = uint64(12)
+	cases["true"] = true
+	cases["\"foo \\\"bar\\\"\""] = "foo \"bar\""
 
-	raw := "foo"
-	conv, err := c.Convert(raw)
-	if err != nil {
-		t.Error(err)
-	} else if raw != conv {
-		t.Fail()
-	}
+	checkConversion(c, cases, t)
 }
 
 func TestConvertFloat(t *testing.T) {
 	c := Conversion{Kind: "float", Precision: 2}
-	cases := make(map[string]string, 10)
-	cases["1"] = "1.00"
-	cases["0"] = "0.00"
-	cases["-1"] = "-1.00"
-	cases["-0"] = "0.00"
-	cases["100"] = "100.00"
-	cases["1.1"] = "1.10"
-	cases["2.123"] = "2.12"
-	cases["2.789"] = "2.79"
-	cases["03"] = "3.00"
-	cases["03.04"] = "3.04"
+	cases := make(map[string]interface{}, 10)
+	cases["1"] = 1.0
+	cases["0"] = 0.0
+	cases["-1"] = -1.0
+	cases["-0"] = 0.0
+	cases["100"] = 100.0
+	cases["1.1"] = 1.1
+	cases["2.123"] = 2.12
+	cases["2.789"] = 2.79
+	cases["03"] = 3.0
+	cases["03.04"] = 3.04
 
 	checkConversion(c, cases, t)
 
@@ -45,14 +49,14 @@ func TestConvertFloat(t *testing.T) {
 func TestConvertInteger(t *testing.T) {
 	c := Conversion{Kind: "integer"}
 
-	cases := make(map[string]string, 7)
-	cases["1"] = "1i"
-	cases["-1"] = "-1i"
-	cases["0"] = "0i"
-	cases["-0"] = "0i"
-	cases["00"] = "0i"
-	cases["01"] = "1i"
-	cases["123"] = "123i"
+	cases := make(map[string]interface{}, 7)
+	cases["1"] = int64(1)
+	cases["-1"] = int64(-1)
+	cases["0"] = int64(0)
+	cases["-0"] = int64(0)
+	cases["00"] = int64(0)
+	cases["01"] = int64(1)
+	cases["123"] = int64(123)
 	checkConversion(c, cases, t)
 
 	expectedErrors := make([]string, 6)
@@ -66,51 +70,112 @@ func TestConvertInteger(t *testing.T) {
 	checkExpectedErrors(c, expectedErrors, t)
 }
 
+func TestConvertUnsigned(t *testing.T) {
+	c := Conversion{Kind: "unsigned"}
+
+	cases := make(map[string]interface{}, 5)
+	cases["1"] = uint64(1)
+	cases["0"] = uint64(0)
+	cases["01"] = uint64(1)
+	cases["9223372036854775808"] = uint64(9223372036854775808)
+	cases["18446744073709551615"] = uint64(18446744073709551615)
+	checkConversion(c, cases, t)
+
+	expectedErrors := make([]string, 6)
+	expectedErrors[0] = ""
+	expectedErrors[1] = "-1"
+	expectedErrors[2] = "-0"
+	expectedErrors[3] = "1.5"
+	expectedErrors[4] = "18446744073709551616"
+	expectedErrors[5] = "foo"
+
+	checkExpectedErrors(c, expectedErrors, t)
+
+	c = Conversion{Kind: "unsigned", Scale: 0.001}
+	cases = make(map[string]interface{}, 2)
+	cases["123456"] = uint64(123)
+	cases["999"] = uint64(0)
+	checkConversion(c, cases, t)
+
+	c = Conversion{Kind: "unsigned", Scale: -1}
+	checkExpectedErrors(c, []string{"1"}, t)
+
+	// integer scales do not round through float
+	c = Conversion{Kind: "unsigned", Scale: 1}
+	cases = make(map[string]interface{}, 1)
+	cases["18446744073709551615"] = uint64(18446744073709551615)
+	checkConversion(c, cases, t)
+
+	c = Conversion{Kind: "unsigned", Scale: 1000}
+	cases = make(map[string]interface{}, 1)
+	cases["9007199254740993"] = uint64(9007199254740993000)
+	checkConversion(c, cases, t)
+	checkExpectedErrors(c, []string{"18446744073709552"}, t)
+}
+
+func TestUnsignedFromJSON(t *testing.T) {
+	s := &Subscription{
+		Measurement: "counter",
+		Value:       `JSON "e"`,
+		Conversion:  Conversion{Kind: "unsigned"},
+	}
+
+	for _, expected := range []uint64{18446744073709551615, 9007199254740993} {
+		payload := fmt.Sprintf(`{"e":%d}`, expected)
+		m, err := s.Read("meter", payload)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", payload, err)
+		} else if m.Values["value"] != expected {
+			t.Errorf("Expected %v, got %v", expected, m.Values["value"])
+		}
+	}
+}
+
 func TestConvertString(t *testing.T) {
 	c := Conversion{Kind: "string"}
 
-	cases := make(map[string]string, 4)
-	cases["foo"] = "\"foo\""
-	cases["foo bar"] = "\"foo bar\""
-	cases["'single'"] = "\"'single'\""
-	cases["\"double\""] = "\"\\\"double\\\"\""
+	cases := make(map[string]interface{}, 4)
+	cases["foo"] = "foo"
+	cases["foo bar"] = "foo bar"
+	cases["'single'"] = "'single'"
+	cases["\"double\""] = "\"double\""
 
 	checkConversion(c, cases, t)
 }
 
 func TestConvertScale(t *testing.T) {
 	c := Conversion{Kind: "float", Scale: 2.0, Precision: 1}
-	cases := make(map[string]string, 3)
-	cases["1"] = "2.0"
-	cases["-1"] = "-2.0"
-	cases["0"] = "0.0"
+	cases := make(map[string]interface{}, 3)
+	cases["1"] = 2.0
+	cases["-1"] = -2.0
+	cases["0"] = 0.0
 
 	checkConversion(c, cases, t)
 
 	c = Conversion{Kind: "float", Scale: 0.1, Precision: 1}
-	cases = make(map[string]string, 5)
-	cases["1"] = "0.1"
-	cases["-1"] = "-0.1"
-	cases["0"] = "0.0"
-	cases["1.1"] = "0.1"
-	cases["1.6"] = "0.2"
+	cases = make(map[string]interface{}, 5)
+	cases["1"] = 0.1
+	cases["-1"] = -0.1
+	cases["0"] = 0.0
+	cases["1.1"] = 0.1
+	cases["1.6"] = 0.2
 
 	checkConversion(c, cases, t)
 }
 
 func TestConvertBoolean(t *testing.T) {
 	c := Conversion{Kind: "boolean"}
-	cases := make(map[string]string, 8)
-	cases["1"] = "true"
-	cases["0"] = "false"
-	cases["true"] = "true"
-	cases["false"] = "false"
-	cases["TRUE"] = "true"
-	cases["FALSE"] = "false"
-	cases["TruE"] = "true"
-	cases["fAlsE"] = "false"
-	cases[" true"] = "true"
-	cases["false "] = "false"
+	cases := make(map[string]interface{}, 8)
+	cases["1"] = true
+	cases["0"] = false
+	cases["true"] = true
+	cases["false"] = false
+	cases["TRUE"] = true
+	cases["FALSE"] = false
+	cases["TruE"] = true
+	cases["fAlsE"] = false
+	cases[" true"] = true
+	cases["false "] = false
 
 	checkConversion(c, cases, t)
 
@@ -128,15 +193,15 @@ func TestConvertBoolean(t *testing.T) {
 
 func TestConvertOnOff(t *testing.T) {
 	c := Conversion{Kind: "on-off"}
-	cases := make(map[string]string, 8)
-	cases["on"] = "true"
-	cases["off"] = "false"
-	cases["ON"] = "true"
-	cases["OFF"] = "false"
-	cases["oN"] = "true"
-	cases["oFf"] = "false"
-	cases[" on"] = "true"
-	cases["off "] = "false"
+	cases := make(map[string]interface{}, 8)
+	cases["on"] = true
+	cases["off"] = false
+	cases["ON"] = true
+	cases["OFF"] = false
+	cases["oN"] = true
+	cases["oFf"] = false
+	cases[" on"] = true
+	cases["off "] = false
 
 	checkConversion(c, cases, t)
 
@@ -150,7 +215,7 @@ func TestConvertOnOff(t *testing.T) {
 	checkExpectedErrors(c, expectedErrors, t)
 }
 
-func checkConversion(c Conversion, cases map[string]string, t *testing.T) {
+func checkConversion(c Conversion, cases map[string]interface{}, t *testing.T) {
 	for raw, expected := range cases {
 		result, err := c.Convert(raw)
 		if err != nil {
@@ -169,3 +234,168 @@ func checkExpectedErrors(c Conversion, cases []string, t *testing.T) {
 		}
 	}
 }
+
+func TestConversionSteps(t *testing.T) {
+	var c Conversion
+	err := json.Unmarshal([]byte(`[
+		{"lookup": {"low": "10", "high": "35"}},
+		{"kind": "float", "scale": 0.5},
+		{"kind": "float", "precision": 1}
+	]`), &c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(c.Steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %v", len(c.Steps))
+	}
+
+	cases := make(map[string]interface{}, 2)
+	cases["low"] = 5.0
+	cases["high"] = 17.5
+	checkConversion(c, cases, t)
+
+	_, err = c.Convert("medium")
+	if err == nil || !strings.Contains(err.Error(), "step 1 (identity)") {
+		t.Errorf("Expected error for step 1, got %v", err)
+	}
+
+	c = Conversion{Steps: []Conversion{{Kind: "float"}, {Kind: "integer"}}}
+	_, err = c.Convert("1.5")
+	if err == nil || !strings.Contains(err.Error(), "step 2 (integer)") {
+		t.Errorf("Expected error for step 2, got %v", err)
+	}
+}
+
+func TestConversionObject(t *testing.T) {
+	var s Subscription
+	err := json.Unmarshal([]byte(`{"conversion": {"kind": "float", "precision": 2}}`), &s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.Conversion.Kind != "float" || s.Conversion.Precision != 2 || len(s.Conversion.Steps) != 0 {
+		t.Errorf("Unexpected conversion %+v", s.Conversion)
+	}
+
+	err = json.Unmarshal([]byte(`{"conversion": [{"kind": 1}]}`), &s)
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestConvertExpression(t *testing.T) {
+	c := Conversion{Kind: "expression", Expression: "value - 273.15", Precision: 2}
+	cases := make(map[string]interface{}, 2)
+	cases["300.15"] = 27.0
+	cases["274.16"] = 1.01
+	checkConversion(c, cases, t)
+	checkExpectedErrors(c, []string{"foo", ""}, t)
+
+	c = Conversion{Kind: "expression", Expression: "value > 10"}
+	cases = make(map[string]interface{}, 2)
+	cases["11"] = true
+	cases["9"] = false
+	checkConversion(c, cases, t)
+
+	s := &Subscription{
+		Measurement: "power",
+		Value:       `JSON "voltage"`,
+		Conversion: Conversion{
+			Kind:       "expression",
+			Expression: `value * JSON "current"`,
+		},
+	}
+	m, err := s.Read("foo/bar", `{"voltage": 230, "current": 0.5}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != 115.0 {
+		t.Errorf("Expected 115, got %v", m.Values["value"])
+	}
+
+	s = &Subscription{
+		Conversion: Conversion{Kind: "expression", Expression: "value +"},
+	}
+	if err := s.parseTemplates(); err == nil {
+		t.Error("Expected error for invalid expression, got OK")
+	}
+}
+
+func TestConvertRegex(t *testing.T) {
+	c := Conversion{Kind: "regex", Pattern: `H=([0-9.]+)%`}
+	checkConversion(c, map[string]interface{}{"T=21.5C;H=40%": "40"}, t)
+	checkExpectedErrors(c, []string{"T=21.5C", ""}, t)
+
+	c = Conversion{Kind: "regex", Pattern: `^(OK|ERR) (?P<count>[0-9]+)$`, Group: 2}
+	checkConversion(c, map[string]interface{}{"OK 1234": "1234"}, t)
+
+	c = Conversion{Kind: "regex", Pattern: `[0-9]+`}
+	checkConversion(c, map[string]interface{}{"OK 1234": "1234"}, t)
+
+	replace := ""
+	c = Conversion{Kind: "regex", Pattern: `[^0-9.\-]`, Replace: &replace}
+	checkConversion(c, map[string]interface{}{"21.5 °C": "21.5", "none": ""}, t)
+
+	swap := "$2.$1"
+	c = Conversion{Kind: "regex", Pattern: `(\d+),(\d+)`, Replace: &swap}
+	checkConversion(c, map[string]interface{}{"5,21": "21.5"}, t)
+
+	// typed by a following step
+	var steps Conversion
+	err := json.Unmarshal([]byte(`[
+		{"kind": "regex", "pattern": "T=(-?[0-9.]+)C"},
+		{"kind": "float"}
+	]`), &steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConversion(steps, map[string]interface{}{"T=21.5C;H=40%": 21.5}, t)
+
+	invalid := []Conversion{
+		{Kind: "regex", Pattern: `[invalid`},
+		{Kind: "regex", Pattern: `(a)`, Group: 2},
+		{Kind: "regex", Pattern: `a`, Group: -1},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", c)
+		}
+	}
+}
+
+func TestInvalidConversionFailsEveryRead(t *testing.T) {
+	invalid := []string{
+		`{"kind": "expression", "expression": "value +"}`,
+		`{"kind": "rate", "to": "kWh"}`,
+		`{"kind": "regex", "pattern": "("}`,
+		`{"kind": "bytes", "length": 9}`,
+		`{"kind": "datetime", "to": "min"}`,
+		`{"lookup": {"0-20": "low", "10-30": "high"}}`,
+	}
+	for _, text := range invalid {
+		var c Conversion
+		err := json.Unmarshal([]byte(text), &c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		s := &Subscription{Measurement: "m", Conversion: c}
+		first, err := s.Read("foo", "1")
+		if err == nil {
+			t.Errorf("%v: expected error, got %v", text, first.Values)
+			continue
+		}
+		_, again := s.Read("foo", "1")
+		if again == nil || again.Error() != err.Error() {
+			t.Errorf("%v: expected %q again, got %v", text, err, again)
+		}
+	}
+
+	s := &Subscription{
+		Measurement: "m",
+		Fields:      map[string]Field{"x": {Value: "Payload", Filter: &Filter{Clamp: true}}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Read("foo", "1"); err == nil {
+			t.Errorf("Read %d: expected error for invalid field filter", i+1)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package mqttinflux
+
+// Rates from counters, e.g. energy meters or network interfaces.
+//
+// The "rate" and "delta" conversions read the counter value; the rate or
+// delta is calculated after the measurement is complete, from the previous
+// value and timestamp of the same series (measurement, tags and field).
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counter reads the value of a counter for the "rate" and "delta" kinds,
+// multiplied by `Scale` if that is given.
+func Counter(raw string, params *Conversion) (interface{}, error) {
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return nil, err
+	}
+	if params.Scale != 0 {
+		parsed = parsed * params.Scale
+	}
+	return parsed, nil
+}
+
+// isCounter tells if the conversion is "rate" or "delta".
+func (c *Conversion) isCounter() bool {
+	return c.Kind == "rate" || c.Kind == "delta"
+}
+
+// counter returns the "rate" or "delta" conversion, which is either the
+// conversion itself or its last step. The result is nil for other kinds.
+func (c *Conversion) counter() *Conversion {
+	if len(c.Steps) != 0 {
+		return c.Steps[len(c.Steps)-1].counter()
+	}
+	if c.isCounter() {
+		return c
+	}
+	return nil
+}
+
+// validateCounter checks the parameters for the "rate" and "delta" kinds.
+func validateCounter(c *Conversion) error {
+	if c.Wrap < 0 {
+		return fmt.Errorf("invalid wrap %v", c.Wrap)
+	}
+	if c.Kind == "rate" && c.To != "" {
+		if u, ok := units[c.To]; !ok || u.dimension != "time" {
+			return fmt.Errorf("invalid time unit %q", c.To)
+		}
+	}
+	return nil
+}
+
+// validateCounterSteps checks that "rate" and "delta" are only used
+// as the last step of a chain.
+func validateCounterSteps(c *Conversion) error {
+	for i := range c.Steps {
+		step := &c.Steps[i]
+		if (step.isCounter() || len(step.Steps) != 0) && i != len(c.Steps)-1 {
+			return fmt.Errorf("conversion step %d: %v must be the last step", i+1, step.Kind)
+		}
+	}
+	return nil
+}
+
+// difference returns the increase from `previous` to `current`.
+// If the counter wrapped around at `Wrap`, the increase is calculated
+// across the wrap; any other decrease is a reset and the second return
+// value is false.
+func (c *Conversion) difference(previous, current float64) (float64, bool) {
+	if current >= previous {
+		return current - previous, true
+	}
+	// a wraparound goes from near the maximum to near zero
+	if c.Wrap != 0 && previous-current > c.Wrap/2 {
+		return current + c.Wrap - previous, true
+	}
+	return 0, false
+}
+
+// calculate returns the rate or delta from the previous sample.
+// The second return value is false after a reset.
+func (c *Conversion) calculate(previous, current counterSample) (float64, bool, error) {
+	diff, ok := c.difference(previous.value, current.value)
+	if !ok {
+		return 0, false, nil
+	}
+
+	result := diff
+	if c.Kind == "rate" {
+		elapsed := current.timestamp.Sub(previous.timestamp).Seconds()
+		to := c.To
+		if to == "" {
+			to = "s"
+		}
+		// seconds per target unit
+		per, err := convertUnit(1, to, "s")
+		if err != nil {
+			return 0, false, err
+		}
+		result = diff / elapsed * per
+	}
+
+	if c.Precision != 0 {
+		result = roundPrecision(result, c.Precision)
+	}
+	return result, true, nil
+}
+
+// counterSample is a counter value and the time it was read.
+type counterSample struct {
+	value     float64
+	timestamp time.Time
+}
+
+// counterState keeps the previous sample of each counter.
+type counterState struct {
+	mutex    sync.Mutex
+	previous map[string]counterSample
+}
+
+func newCounterState() *counterState {
+	return &counterState{
+		previous: make(map[string]counterSample),
+	}
+}
+
+// update stores the current sample for the counter with the given key
+// and returns the rate or delta. The second return value is false for the
+// first sample and after a reset.
+func (st *counterState) update(key string, current counterSample, c *Conversion) (float64, bool, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	previous, ok := st.previous[key]
+	if ok && !current.timestamp.After(previous.timestamp) {
+		// out of order or duplicate, keep the previous sample
+		return 0, false, nil
+	}
+	st.previous[key] = current
+	if !ok {
+		return 0, false, nil
+	}
+	return c.calculate(previous, current)
+}
+
+// counterFor returns the "rate" or "delta" conversion for a field,
+// or nil if the field has no counter conversion.
+func (s *Subscription) counterFor(field string) *Conversion {
+	if f, ok := s.Fields[field]; ok {
+		return f.Conversion.counter()
+	}
+	if field == "value" {
+		return s.Conversion.counter()
+	}
+	return nil
+}
+
+// hasCounters tells if the subscription or any of its fields
+// use a "rate" or "delta" conversion.
+func (s *Subscription) hasCounters() bool {
+	if s.Conversion.counter() != nil {
+		return true
+	}
+	for _, f := range s.Fields {
+		if f.Conversion.counter() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCounters replaces counter values with their rate or delta.
+// The first sample of each counter and samples after a reset are dropped,
+// as are Measurements without any remaining values.
+// Fields which cannot be calculated are dropped and the first error
+// is returned.
+func (s *Subscription) applyCounters(measurements []Measurement) ([]Measurement, error) {
+	if s.counters == nil {
+		return measurements, nil
+	}
+
+	var firstErr error
+	result := measurements[:0]
+	for _, m := range measurements {
+		key := seriesKey(&m)
+		for name, value := range m.Values {
+			c := s.counterFor(name)
+			if c == nil {
+				continue
+			}
+			x, ok := toFloat(value)
+			if !ok {
+				continue
+			}
+			sample := counterSample{value: x, timestamp: m.Timestamp}
+			calculated, ok, err := s.counters.update(key+" "+name, sample, c)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("field %q: %v", name, err)
+			}
+			if !ok {
+				delete(m.Values, name)
+				continue
+			}
+			m.Values[name] = calculated
+		}
+		if len(m.Values) != 0 {
+			result = append(result, m)
+		}
+	}
+	return result, firstErr
+}
@@ -0,0 +1,111 @@
+package mqttinflux
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func counterSubscription(conversion string, t *testing.T) *Subscription {
+	var s Subscription
+	err := json.Unmarshal([]byte(`{
+		"measurement": "counter",
+		"tags": {"device": "{{.Topic 0}}"},
+		"value": "JSON \"value\"",
+		"timestamp": "JSON \"ts\"",
+		"conversion": `+conversion+`
+	}`), &s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return &s
+}
+
+func TestConvertRate(t *testing.T) {
+	s := counterSubscription(`{"kind": "rate"}`, t)
+	values := readValues(s, "eth0", []string{
+		`{"ts": 100, "value": 1000}`,
+		`{"ts": 110, "value": 1500}`,
+		`{"ts": 110, "value": 1600}`,
+		`{"ts": 130, "value": 200}`,
+		`{"ts": 140, "value": 300}`,
+	}, t)
+	// first sample, duplicate timestamp and reset are skipped
+	checkValues(values, []interface{}{50.0, 10.0}, t)
+
+	// each series has its own counter
+	values = readValues(s, "eth1", []string{`{"ts": 140, "value": 5}`}, t)
+	checkValues(values, nil, t)
+
+	s = counterSubscription(`{"kind": "rate", "scale": 0.001, "to": "h", "precision": 2}`, t)
+	values = readValues(s, "meter", []string{
+		`{"ts": 0, "value": 100000}`,
+		`{"ts": 60, "value": 100050}`,
+	}, t)
+	checkValues(values, []interface{}{3.0}, t)
+}
+
+func TestConvertDelta(t *testing.T) {
+	s := counterSubscription(`{"kind": "delta", "wrap": 4294967296}`, t)
+	values := readValues(s, "eth0", []string{
+		`{"ts": 1, "value": 4294967000}`,
+		`{"ts": 2, "value": 4294967290}`,
+		`{"ts": 3, "value": 100}`,
+		`{"ts": 4, "value": 50}`,
+		`{"ts": 5, "value": 60}`,
+	}, t)
+	// wraparound from 4294967290 to 100, then a reset to 50
+	checkValues(values, []interface{}{290.0, 106.0, 10.0}, t)
+
+	s = counterSubscription(`[{"kind": "regex", "pattern": "([0-9]+) kWh"}, {"kind": "delta"}]`, t)
+	values = readValues(s, "meter", []string{
+		`{"ts": 1, "value": "12 kWh"}`,
+		`{"ts": 2, "value": "15 kWh"}`,
+	}, t)
+	checkValues(values, []interface{}{3.0}, t)
+}
+
+func TestCounterFields(t *testing.T) {
+	s := &Subscription{
+		Measurement: "net",
+		Timestamp:   `JSON "ts"`,
+		Fields: map[string]Field{
+			"rx":  {Value: `JSON "rx"`, Conversion: Conversion{Kind: "rate"}},
+			"mtu": {Value: `JSON "mtu"`, Conversion: Conversion{Kind: "integer"}},
+		},
+	}
+	for i, payload := range []string{`{"ts": 0, "rx": 0, "mtu": 1500}`, `{"ts": 2, "rx": 10, "mtu": 1500}`} {
+		measurements, err := s.ReadAll("eth0", payload)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		values := measurements[0].Values
+		if i == 0 {
+			if _, ok := values["rx"]; ok {
+				t.Errorf("Expected first sample to be skipped, got %v", values["rx"])
+			}
+		} else if values["rx"] != 5.0 {
+			t.Errorf("Expected rate 5, got %v", values["rx"])
+		}
+		if values["mtu"] != int64(1500) {
+			t.Errorf("Expected mtu 1500, got %v", values["mtu"])
+		}
+	}
+}
+
+func TestCounterValidate(t *testing.T) {
+	invalid := []string{
+		`{"kind": "rate", "to": "kWh"}`,
+		`{"kind": "delta", "wrap": -1}`,
+		`[{"kind": "delta"}, {"kind": "float"}]`,
+	}
+	for _, text := range invalid {
+		var c Conversion
+		err := json.Unmarshal([]byte(text), &c)
+		if err == nil {
+			err = c.validate()
+		}
+		if err == nil {
+			t.Errorf("Expected error for %v, got OK", text)
+		}
+	}
+}
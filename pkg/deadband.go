@@ -0,0 +1,153 @@
+package mqttinflux
+
+// Change-only writes: a measurement is skipped if its values did not change
+// (or changed less than the deadband) since the last measurement that was
+// written for the same series.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deadband is the minimum change for numeric values, either absolute
+// or in percent of the last written value.
+// In JSON, it is either a number (`0.5`) or a string (`"0.5"` or `"2%"`).
+type Deadband struct {
+	Value   float64
+	Percent bool
+}
+
+// UnmarshalJSON reads the deadband from a number or a string.
+func (d *Deadband) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var number float64
+		if err := json.Unmarshal(data, &number); err != nil {
+			return fmt.Errorf("invalid deadband %s", data)
+		}
+		*d = Deadband{Value: number}
+		return nil
+	}
+
+	s = strings.TrimSpace(s)
+	percent := strings.HasSuffix(s, "%")
+	value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+	if err != nil {
+		return fmt.Errorf("invalid deadband %q", s)
+	}
+	*d = Deadband{Value: value, Percent: percent}
+	return nil
+}
+
+// exceeded tells if the change from `last` to `x` is larger than the deadband.
+func (d Deadband) exceeded(last, x float64) bool {
+	band := d.Value
+	if d.Percent {
+		band = math.Abs(last) * d.Value / 100
+	}
+	return math.Abs(x-last) > band
+}
+
+// lastWrite is the last measurement that was written for a series.
+type lastWrite struct {
+	values    map[string]interface{}
+	timestamp time.Time
+}
+
+// changeState keeps the last written values for each series.
+type changeState struct {
+	mutex sync.Mutex
+	last  map[string]lastWrite
+}
+
+func newChangeState() *changeState {
+	return &changeState{
+		last: make(map[string]lastWrite),
+	}
+}
+
+// changeOnly tells if measurements are written only when they change.
+func (s *Subscription) changeOnly() bool {
+	return s.OnChangeOnly || s.Deadband.Value != 0
+}
+
+// validateChangeOnly checks the options for change-only writes
+// and returns the parsed `MaxInterval`.
+func (s *Subscription) validateChangeOnly() (time.Duration, error) {
+	if s.Deadband.Value < 0 {
+		return 0, fmt.Errorf("invalid deadband %v", s.Deadband.Value)
+	}
+	if s.MaxInterval == "" {
+		return 0, nil
+	}
+	if !s.changeOnly() {
+		return 0, fmt.Errorf("maxInterval requires onChangeOnly or deadband")
+	}
+	seconds, err := parseDuration(strings.TrimSpace(s.MaxInterval), "s")
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid maxInterval %q", s.MaxInterval)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// skipUnchanged drops measurements which did not change since the last
+// measurement that was written for the same series, unless `MaxInterval`
+// has passed.
+func (s *Subscription) skipUnchanged(measurements []Measurement) []Measurement {
+	if s.changes == nil {
+		return measurements
+	}
+
+	s.changes.mutex.Lock()
+	defer s.changes.mutex.Unlock()
+
+	result := measurements[:0]
+	for _, m := range measurements {
+		key := seriesKey(&m)
+		last, ok := s.changes.last[key]
+		if ok && !s.changed(last, &m) {
+			continue
+		}
+
+		values := make(map[string]interface{}, len(m.Values))
+		for name, value := range m.Values {
+			values[name] = value
+		}
+		s.changes.last[key] = lastWrite{values: values, timestamp: m.Timestamp}
+		result = append(result, m)
+	}
+	return result
+}
+
+// changed tells if a measurement differs from the last written values
+// or if it is due because of the `MaxInterval`.
+func (s *Subscription) changed(last lastWrite, m *Measurement) bool {
+	if s.maxInterval != 0 && m.Timestamp.Sub(last.timestamp) >= s.maxInterval {
+		return true
+	}
+	if len(last.values) != len(m.Values) {
+		return true
+	}
+
+	for name, value := range m.Values {
+		lastValue, ok := last.values[name]
+		if !ok {
+			return true
+		}
+		x, isNumber := toFloat(value)
+		lastX, lastIsNumber := toFloat(lastValue)
+		if isNumber && lastIsNumber {
+			if s.Deadband.exceeded(lastX, x) {
+				return true
+			}
+		} else if value != lastValue {
+			return true
+		}
+	}
+	return false
+}
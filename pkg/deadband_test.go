@@ -0,0 +1,126 @@
+package mqttinflux
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOnChangeOnly(t *testing.T) {
+	s := &Subscription{
+		Measurement:  "state",
+		Tags:         map[string]string{"device": "{{.Topic 0}}"},
+		Conversion:   Conversion{Kind: "string"},
+		OnChangeOnly: true,
+	}
+	values := readValues(s, "washer", []string{"idle", "idle", "running", "running", "idle"}, t)
+	checkValues(values, []interface{}{"idle", "running", "idle"}, t)
+
+	// each series has its own last value
+	values = readValues(s, "dryer", []string{"idle"}, t)
+	checkValues(values, []interface{}{"idle"}, t)
+
+	s = &Subscription{
+		Measurement:  "climate",
+		OnChangeOnly: true,
+		Fields: map[string]Field{
+			"temperature": {Value: `JSON "t"`, Conversion: Conversion{Kind: "float"}},
+			"humidity":    {Value: `JSON "h"`, Conversion: Conversion{Kind: "float"}},
+		},
+	}
+	count := 0
+	for _, payload := range []string{`{"t": 21, "h": 40}`, `{"t": 21, "h": 40}`, `{"t": 21, "h": 41}`} {
+		measurements, err := s.ReadAll("climate", payload)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		count += len(measurements)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 measurements, got %d", count)
+	}
+}
+
+func TestDeadband(t *testing.T) {
+	s := &Subscription{
+		Measurement: "temperature",
+		Conversion:  Conversion{Kind: "float"},
+		Deadband:    Deadband{Value: 0.5},
+	}
+	// the band is relative to the last written value
+	values := readValues(s, "kitchen", []string{"21", "21.3", "21.5", "21.6", "21.2", "21.1", "20.9"}, t)
+	checkValues(values, []interface{}{21.0, 21.6, 20.9}, t)
+
+	s = &Subscription{
+		Measurement: "power",
+		Conversion:  Conversion{Kind: "integer"},
+		Deadband:    Deadband{Value: 10, Percent: true},
+	}
+	values = readValues(s, "plug", []string{"1000", "1090", "1101", "1200", "1215"}, t)
+	checkValues(values, []interface{}{int64(1000), int64(1101), int64(1215)}, t)
+}
+
+func TestMaxInterval(t *testing.T) {
+	var s Subscription
+	err := json.Unmarshal([]byte(`{
+		"measurement": "temperature",
+		"value": "JSON \"value\"",
+		"timestamp": "JSON \"ts\"",
+		"conversion": {"kind": "float"},
+		"deadband": "1%",
+		"maxInterval": "5m"
+	}`), &s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !s.Deadband.Percent || s.Deadband.Value != 1 {
+		t.Errorf("Unexpected deadband %+v", s.Deadband)
+	}
+
+	payloads := []string{
+		`{"ts": 0, "value": 20}`,
+		`{"ts": 60, "value": 20.1}`,
+		`{"ts": 299, "value": 20}`,
+		`{"ts": 300, "value": 20}`,
+		`{"ts": 360, "value": 20}`,
+	}
+	var timestamps []int64
+	for _, payload := range payloads {
+		measurements, err := s.ReadAll("kitchen", payload)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, m := range measurements {
+			timestamps = append(timestamps, m.Timestamp.Unix())
+		}
+	}
+	if len(timestamps) != 2 || timestamps[0] != 0 || timestamps[1] != 300 {
+		t.Errorf("Expected writes at 0 and 300, got %v", timestamps)
+	}
+}
+
+func TestChangeOnlyValidate(t *testing.T) {
+	invalid := []string{
+		`{"maxInterval": "5m"}`,
+		`{"onChangeOnly": true, "maxInterval": "soon"}`,
+		`{"onChangeOnly": true, "maxInterval": "-5m"}`,
+		`{"deadband": -1}`,
+	}
+	for _, text := range invalid {
+		var s Subscription
+		err := json.Unmarshal([]byte(text), &s)
+		if err == nil {
+			err = s.parseTemplates()
+		}
+		if err == nil {
+			t.Errorf("Expected error for %v, got OK", text)
+		}
+	}
+
+	var d Deadband
+	if err := json.Unmarshal([]byte(`"five"`), &d); err == nil {
+		t.Errorf("Expected error for invalid deadband, got %+v", d)
+	}
+	if err := json.Unmarshal([]byte(`true`), &d); err == nil {
+		t.Errorf("Expected error for invalid deadband, got %+v", d)
+	}
+}
@@ -0,0 +1,273 @@
+package mqttinflux
+
+// Conversions for durations (e.g. uptime) and points in time
+// (e.g. last seen).
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ISO 8601 duration, e.g. "P1DT12H" or "PT1H30M"
+var isoDurationPattern = regexp.MustCompile(`^P(?:([0-9.,]+)Y)?(?:([0-9.,]+)M)?(?:([0-9.,]+)W)?(?:([0-9.,]+)D)?(?:T(?:([0-9.,]+)H)?(?:([0-9.,]+)M)?(?:([0-9.,]+)S)?)?$`)
+
+// seconds for each part of an ISO 8601 duration,
+// years and months are approximated with 365 and 30 days
+var isoDurationUnits = []float64{365 * 86400, 30 * 86400, 7 * 86400, 86400, 3600, 60, 1}
+
+// a number followed by a unit in a humanized duration, e.g. "4h" or "12 min"
+var humanDurationPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zµ]+)`)
+
+// clock time as used by uptime, e.g. "04:12" or "04:12:30.5"
+var clockDurationPattern = regexp.MustCompile(`^([0-9]+):([0-9]{2})(?::([0-9]{2}(?:\.[0-9]+)?))?$`)
+
+// seconds for the units in a humanized duration
+var humanDurationUnits = map[string]float64{
+	"ns": 1e-9, "us": 1e-6, "µs": 1e-6, "ms": 1e-3,
+	"s": 1, "sec": 1, "secs": 1, "second": 1, "seconds": 1,
+	"m": 60, "min": 60, "mins": 60, "minute": 60, "minutes": 60,
+	"h": 3600, "hr": 3600, "hrs": 3600, "hour": 3600, "hours": 3600,
+	"d": 86400, "day": 86400, "days": 86400,
+	"w": 604800, "wk": 604800, "week": 604800, "weeks": 604800,
+}
+
+// Duration converts a duration to a number in the unit given in `To`
+// (default: seconds). The input is either in Go format ("1h30m"),
+// ISO 8601 ("PT1H30M"), humanized ("3d 4h 12m", "2 days, 04:12:00")
+// or a plain number in the unit given in `From` (default: seconds).
+// The result is a float, or an integer if `Integer` is set.
+func Duration(raw string, params *Conversion) (interface{}, error) {
+	seconds, err := parseDuration(strings.TrimSpace(raw), params.From)
+	if err != nil {
+		return nil, err
+	}
+
+	to := params.To
+	if to == "" {
+		to = "s"
+	}
+	converted, err := convertUnit(seconds, "s", to)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Integer {
+		return int64(math.Round(converted)), nil
+	}
+	if params.Precision != 0 {
+		converted = roundPrecision(converted, params.Precision)
+	}
+	return converted, nil
+}
+
+// parseDuration reads a duration in one of the supported formats
+// and returns the number of seconds.
+func parseDuration(s, from string) (float64, error) {
+	if s == "" {
+		return 0, errors.New("empty duration")
+	}
+
+	if number, err := strconv.ParseFloat(s, 64); err == nil {
+		if from == "" {
+			from = "s"
+		}
+		return convertUnit(number, from, "s")
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), nil
+	}
+
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+
+	var seconds float64
+	var err error
+	if strings.HasPrefix(s, "P") {
+		seconds, err = parseISODuration(s)
+	} else {
+		seconds, err = parseHumanDuration(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return sign * seconds, nil
+}
+
+func parseISODuration(s string) (float64, error) {
+	groups := isoDurationPattern.FindStringSubmatch(s)
+	if groups == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid ISO 8601 duration %q", s)
+	}
+
+	var seconds float64
+	for i, part := range groups[1:] {
+		if part == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.Replace(part, ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ISO 8601 duration %q", s)
+		}
+		seconds += number * isoDurationUnits[i]
+	}
+	return seconds, nil
+}
+
+func parseHumanDuration(s string) (float64, error) {
+	var seconds float64
+	rest := strings.ToLower(s)
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		rest = strings.TrimPrefix(rest, "and ")
+		if rest == "" {
+			return seconds, nil
+		}
+
+		if groups := clockDurationPattern.FindStringSubmatch(rest); groups != nil {
+			hours, _ := strconv.ParseFloat(groups[1], 64)
+			minutes, _ := strconv.ParseFloat(groups[2], 64)
+			secs, _ := strconv.ParseFloat(groups[3], 64)
+			return seconds + hours*3600 + minutes*60 + secs, nil
+		}
+
+		groups := humanDurationPattern.FindStringSubmatch(rest)
+		if groups == nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		factor, ok := humanDurationUnits[groups[2]]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit %q in duration %q", groups[2], s)
+		}
+		number, err := strconv.ParseFloat(groups[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		seconds += number * factor
+		rest = rest[len(groups[0]):]
+	}
+}
+
+// named layouts for the datetime conversion
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339Nano,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+}
+
+// precision for the result of the datetime conversion
+var epochUnits = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
+
+// Datetime parses a point in time and converts it to unix time,
+// an integer in the precision given in `To` (s, ms, us or ns; default: s).
+// `Layout` is either a Go time layout or the name of a standard format
+// (default: RFC3339). Times without a zone are read in `Timezone`
+// (default: UTC).
+func Datetime(raw string, params *Conversion) (interface{}, error) {
+	layout, location, unit, err := params.datetimeParams()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := time.ParseInLocation(layout, strings.TrimSpace(raw), location)
+	if err != nil {
+		return nil, err
+	}
+
+	if unit == time.Second {
+		return t.Unix(), nil
+	}
+	sec, factor := t.Unix(), int64(time.Second/unit)
+	epoch := sec * factor
+	frac := int64(t.Nanosecond()) / int64(unit)
+	if epoch/factor != sec || epoch+frac < epoch {
+		return nil, fmt.Errorf("time %v is out of range for precision %q", t, params.To)
+	}
+	return epoch + frac, nil
+}
+
+// datetimeParams resolves the layout, location and precision
+// for the "datetime" kind.
+func (c *Conversion) datetimeParams() (string, *time.Location, time.Duration, error) {
+	layout := c.Layout
+	if layout == "" {
+		layout = time.RFC3339Nano
+	} else if named, ok := timeLayouts[layout]; ok {
+		layout = named
+	}
+
+	location := time.UTC
+	if c.Timezone != "" {
+		var err error
+		location, err = cachedLocation(c.Timezone)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("invalid timezone %q: %v", c.Timezone, err)
+		}
+	}
+
+	to := c.To
+	if to == "" {
+		to = "s"
+	}
+	unit, ok := epochUnits[to]
+	if !ok {
+		return "", nil, 0, fmt.Errorf("invalid precision %q, must be s, ms, us or ns", c.To)
+	}
+	return layout, location, unit, nil
+}
+
+// loaded time zones for datetime conversions
+var (
+	locationCache      = make(map[string]*time.Location)
+	locationCacheMutex sync.Mutex
+)
+
+func cachedLocation(name string) (*time.Location, error) {
+	locationCacheMutex.Lock()
+	defer locationCacheMutex.Unlock()
+
+	if loc, ok := locationCache[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locationCache[name] = loc
+	return loc, nil
+}
+
+// validateDuration checks the units for the "duration" kind.
+func validateDuration(c *Conversion) error {
+	for _, name := range []string{c.From, c.To} {
+		if name == "" {
+			continue
+		}
+		if u, ok := units[name]; !ok || u.dimension != "time" {
+			return fmt.Errorf("invalid time unit %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package mqttinflux
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertDuration(t *testing.T) {
+	cases := []struct {
+		raw      string
+		expected float64
+	}{
+		{"90", 90},
+		{"1.5", 1.5},
+		{"1h30m", 5400},
+		{"-1m30s", -90},
+		{"PT1H30M", 5400},
+		{"P1DT12H", 129600},
+		{"P2W", 1209600},
+		{"PT0,5S", 0.5},
+		{"-PT1M", -60},
+		{"3d 4h 12m", 274320},
+		{"3d4h", 273600},
+		{"2 days, 04:12:00", 187920},
+		{"1 hour and 30 minutes", 5400},
+		{"1 Week", 604800},
+		{"04:12", 15120},
+		{"250 ms", 0.25},
+	}
+
+	c := Conversion{Kind: "duration"}
+	for _, tc := range cases {
+		result, err := c.Convert(tc.raw)
+		if err != nil {
+			t.Errorf("Converting %q: %v", tc.raw, err)
+			continue
+		}
+		if math.Abs(result.(float64)-tc.expected) > 1e-9 {
+			t.Errorf("Converting %q: expected %v, got %v", tc.raw, tc.expected, result)
+		}
+	}
+	checkExpectedErrors(c, []string{"", "P", "PT", "P1H", "3 fortnights", "soon", "3d 4x"}, t)
+
+	c = Conversion{Kind: "duration", To: "ms", Integer: true}
+	checkConversion(c, map[string]interface{}{"1.5s": int64(1500), "PT0.25S": int64(250)}, t)
+
+	c = Conversion{Kind: "duration", From: "ms", To: "h", Precision: 2}
+	checkConversion(c, map[string]interface{}{"5400000": 1.5, "20m": 0.33}, t)
+
+	invalid := []Conversion{
+		{Kind: "duration", To: "kWh"},
+		{Kind: "duration", From: "fortnight"},
+		{Kind: "datetime", To: "min"},
+		{Kind: "datetime", Timezone: "Nowhere/Special"},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", c)
+		}
+	}
+}
+
+func TestConvertDatetime(t *testing.T) {
+	c := Conversion{Kind: "datetime"}
+	checkConversion(c, map[string]interface{}{
+		"2020-01-02T03:04:05Z":          int64(1577934245),
+		"2020-01-02T04:04:05.999+01:00": int64(1577934245),
+		"1969-12-31T23:59:59Z":          int64(-1),
+	}, t)
+	checkExpectedErrors(c, []string{"", "yesterday", "2020-01-02 03:04:05"}, t)
+
+	c = Conversion{Kind: "datetime", Layout: "DateTime", To: "ms"}
+	checkConversion(c, map[string]interface{}{"2020-01-02 03:04:05": int64(1577934245000)}, t)
+
+	c = Conversion{Kind: "datetime", Layout: "02.01.2006 15:04:05.000", To: "us"}
+	checkConversion(c, map[string]interface{}{"02.01.2020 03:04:05.123": int64(1577934245123000)}, t)
+
+	c = Conversion{Kind: "datetime", Layout: "RFC1123", To: "ns"}
+	checkConversion(c, map[string]interface{}{
+		"Thu, 02 Jan 2020 03:04:05 UTC": int64(1577934245000000000),
+		"Fri, 11 Apr 2262 23:47:16 UTC": int64(9223372036000000000),
+	}, t)
+	checkExpectedErrors(c, []string{"Sat, 12 Apr 2262 00:00:00 UTC", "Mon, 01 Jan 1600 00:00:00 UTC"}, t)
+
+	c = Conversion{Kind: "datetime", Layout: "RFC3339", To: "ms"}
+	checkConversion(c, map[string]interface{}{"2500-01-01T00:00:00Z": int64(16725225600000)}, t)
+}
@@ -0,0 +1,783 @@
+package mqttinflux
+
+// Expressions are used for conditions (`when`) on subscriptions
+// and for the "expression" conversion.
+//
+// Grammar:
+//
+//    expr     = and { "||" and }
+//    and      = not { "&&" not }
+//    not      = "!" not | cmp
+//    cmp      = sum [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "=~" | "!~" ) sum ]
+//    sum      = product { ( "+" | "-" ) product }
+//    product  = unary { ( "*" | "/" | "%" ) unary }
+//    unary    = "-" unary | operand
+//    operand  = string | number | "true" | "false" | "value" | "(" expr ")" | function | call
+//    function = name "(" [ expr { "," expr } ] ")"
+//    call     = Name { string | number }
+//
+// A `call` refers to a method or field of the `TemplateContext`
+// and is evaluated like the template `{{.Name args...}}`,
+// e.g. `JSON "foo.bar"` or `Topic 1`.
+// A `function` is one of the math functions in `exprFunctions`.
+// `value` is the raw value in a conversion.
+//
+// Strings are enclosed in double or single quotes.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+)
+
+// ErrSkipped is returned when a message is not written
+// because the subscription's condition does not hold.
+var ErrSkipped = errors.New("message skipped by condition")
+
+type exprNode interface {
+	eval(ctx *TemplateContext) (interface{}, error)
+}
+
+// parseExpr parses the given expression.
+func parseExpr(text string) (exprNode, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.peek().text, text)
+	}
+	return node, nil
+}
+
+// parsed expressions for conversions, by expression text
+var (
+	exprCache      = make(map[string]exprNode)
+	exprCacheMutex sync.Mutex
+)
+
+// cachedExpr parses an expression or returns it from the cache.
+func cachedExpr(text string) (exprNode, error) {
+	exprCacheMutex.Lock()
+	defer exprCacheMutex.Unlock()
+
+	if node, ok := exprCache[text]; ok {
+		return node, nil
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("empty expression")
+	}
+	node, err := parseExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	exprCache[text] = node
+	return node, nil
+}
+
+// evalCondition evaluates `node` and reports whether the result is "true".
+// Conditions that cannot be evaluated, e.g. because a JSON field is missing,
+// do not hold.
+func evalCondition(node exprNode, ctx *TemplateContext) bool {
+	result, err := node.eval(ctx)
+	if err != nil {
+		return false
+	}
+	return truthy(result)
+}
+
+// Tokenizer ------------------------------------------------------------------
+
+type tokenKind int
+
+const (
+	tokenOperator tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenName
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// operators, longest first
+var exprOperators = []string{
+	"==", "!=", "<=", ">=", "=~", "!~", "&&", "||",
+	"<", ">", "!", "(", ")", "-", "+", "*", "/", "%", ",",
+}
+
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string in expression %q", text)
+			}
+			s, err := unquote(string(runes[i : end+1]))
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, s})
+			i = end + 1
+
+		case unicode.IsDigit(r) || r == '.':
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			// exponent, e.g. 1.5e-3
+			if end < len(runes) && (runes[end] == 'e' || runes[end] == 'E') {
+				exp := end + 1
+				if exp < len(runes) && (runes[exp] == '+' || runes[exp] == '-') {
+					exp++
+				}
+				if exp < len(runes) && unicode.IsDigit(runes[exp]) {
+					end = exp
+					for end < len(runes) && unicode.IsDigit(runes[end]) {
+						end++
+					}
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[i:end])})
+			i = end
+
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, token{tokenName, string(runes[i:end])})
+			i = end
+
+		default:
+			op := ""
+			rest := string(runes[i:])
+			for _, candidate := range exprOperators {
+				if strings.HasPrefix(rest, candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q in expression %q", r, text)
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i += len([]rune(op))
+		}
+	}
+	return tokens, nil
+}
+
+// unquote a single- or double-quoted string.
+func unquote(quoted string) (string, error) {
+	if strings.HasPrefix(quoted, "'") {
+		inner := quoted[1 : len(quoted)-1]
+		inner = strings.ReplaceAll(inner, "\\'", "'")
+		inner = strings.ReplaceAll(inner, "\"", "\\\"")
+		quoted = "\"" + inner + "\""
+	}
+	return strconv.Unquote(quoted)
+}
+
+// Parser ---------------------------------------------------------------------
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *exprParser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// accept consumes the next token if it is one of the given operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator || p.done() {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "!~")
+	if !ok {
+		return left, nil
+	}
+
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &compareNode{op: op, left: left, right: right}
+	if op == "=~" || op == "!~" {
+		lit, ok := right.(*literalNode)
+		if !ok {
+			return nil, fmt.Errorf("operator %v requires a literal pattern", op)
+		}
+		node.pattern, err = regexp.Compile(fmt.Sprintf("%v", lit.value))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithmeticNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateNode{operand: operand}, nil
+	}
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.done() {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	if _, ok := p.accept("("); ok {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, errors.New("missing ')' in expression")
+		}
+		return node, nil
+	}
+
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return &literalNode{value: t.text}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literalNode{value: f}, nil
+	case tokenName:
+		if t.text == "true" || t.text == "false" {
+			return &literalNode{value: t.text == "true"}, nil
+		}
+		if t.text == "value" {
+			return &valueNode{}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseFunction(t.text)
+		}
+		return p.parseCall(t.text)
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", t.text)
+}
+
+// parseCall reads the arguments for a call to `name` and prepares
+// the respective template.
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	text := "{{." + name
+	for !p.done() {
+		t := p.peek()
+		if t.kind == tokenString {
+			text += " " + strconv.Quote(t.text)
+		} else if t.kind == tokenNumber {
+			text += " " + t.text
+		} else {
+			break
+		}
+		p.pos++
+	}
+	text += "}}"
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &callNode{text: text, tmpl: tmpl}, nil
+}
+
+// parseFunction reads the arguments for a math function,
+// the opening parenthesis is already consumed.
+func (p *exprParser) parseFunction(name string) (exprNode, error) {
+	fn, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+
+	node := &functionNode{name: name, fn: fn}
+	if _, ok := p.accept(")"); ok {
+		return node, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		node.args = append(node.args, arg)
+
+		if _, ok := p.accept(")"); ok {
+			return node, nil
+		}
+		if _, ok := p.accept(","); !ok {
+			return nil, fmt.Errorf("missing ')' after arguments for %v", name)
+		}
+	}
+}
+
+// Nodes ----------------------------------------------------------------------
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(ctx *TemplateContext) (interface{}, error) {
+	return n.value, nil
+}
+
+type callNode struct {
+	text string
+	tmpl *template.Template
+}
+
+func (n *callNode) eval(ctx *TemplateContext) (interface{}, error) {
+	buf := new(bytes.Buffer)
+	err := n.tmpl.Execute(buf, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
+
+type negateNode struct {
+	operand exprNode
+}
+
+func (n *negateNode) eval(ctx *TemplateContext) (interface{}, error) {
+	value, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := toNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %q", value)
+	}
+	return -f, nil
+}
+
+type valueNode struct{}
+
+func (n *valueNode) eval(ctx *TemplateContext) (interface{}, error) {
+	if ctx == nil || ctx.value == nil {
+		return nil, errors.New("no value")
+	}
+	return *ctx.value, nil
+}
+
+type arithmeticNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (n *arithmeticNode) eval(ctx *TemplateContext) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a, ok := toNumber(left)
+	if !ok {
+		return nil, fmt.Errorf("not a number: %q", toString(left))
+	}
+	b, ok := toNumber(right)
+	if !ok {
+		return nil, fmt.Errorf("not a number: %q", toString(right))
+	}
+
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q", n.op)
+}
+
+// exprFunction is a math function for expressions.
+type exprFunction func(args []float64) (float64, error)
+
+var exprFunctions = map[string]exprFunction{
+	"abs": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, errors.New("abs requires one argument")
+		}
+		return math.Abs(args[0]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("min requires at least one argument")
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("max requires at least one argument")
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	},
+	// round(x) or round(x, digits)
+	"round": func(args []float64) (float64, error) {
+		switch len(args) {
+		case 1:
+			return math.Round(args[0]), nil
+		case 2:
+			return roundPrecision(args[0], int(args[1])), nil
+		}
+		return 0, errors.New("round requires one or two arguments")
+	},
+	// log(x) is the natural logarithm, log(x, base) for other bases
+	"log": func(args []float64) (float64, error) {
+		if len(args) != 1 && len(args) != 2 {
+			return 0, errors.New("log requires one or two arguments")
+		}
+		if args[0] <= 0 {
+			return 0, fmt.Errorf("log of %v", args[0])
+		}
+		if len(args) == 2 {
+			if args[1] <= 0 || args[1] == 1 {
+				return 0, fmt.Errorf("invalid base %v for log", args[1])
+			}
+			return math.Log(args[0]) / math.Log(args[1]), nil
+		}
+		return math.Log(args[0]), nil
+	},
+	"pow": func(args []float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, errors.New("pow requires two arguments")
+		}
+		result := math.Pow(args[0], args[1])
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return 0, fmt.Errorf("pow(%v, %v) is not a number", args[0], args[1])
+		}
+		return result, nil
+	},
+}
+
+type functionNode struct {
+	name string
+	fn   exprFunction
+	args []exprNode
+}
+
+func (n *functionNode) eval(ctx *TemplateContext) (interface{}, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := toNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("%v: not a number: %q", n.name, toString(value))
+		}
+		args[i] = f
+	}
+	return n.fn(args)
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) eval(ctx *TemplateContext) (interface{}, error) {
+	value, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+type logicalNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (n *logicalNode) eval(ctx *TemplateContext) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// short circuit
+	if n.op == "&&" && !truthy(left) {
+		return false, nil
+	} else if n.op == "||" && truthy(left) {
+		return true, nil
+	}
+
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(right), nil
+}
+
+type compareNode struct {
+	op      string
+	left    exprNode
+	right   exprNode
+	pattern *regexp.Regexp
+}
+
+func (n *compareNode) eval(ctx *TemplateContext) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.pattern != nil {
+		matched := n.pattern.MatchString(toString(left))
+		return matched == (n.op == "=~"), nil
+	}
+
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare as numbers if possible, as strings otherwise
+	var cmp int
+	a, aok := toNumber(left)
+	b, bok := toNumber(right)
+	if aok && bok {
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(toString(left), toString(right))
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q", n.op)
+}
+
+// Values ---------------------------------------------------------------------
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// truthy reports whether a value counts as "true" in a condition.
+// Empty strings, "false", zero and `false` are false, everything else is true.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" || strings.EqualFold(s, "false") {
+			return false
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f != 0
+		}
+		return true
+	}
+	return value != nil
+}
@@ -0,0 +1,147 @@
+package mqttinflux
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConditions(t *testing.T) {
+	payload := `{"type": "reading", "value": 21.5, "ok": true}`
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar/baz", payload)
+
+	cases := map[string]bool{
+		`JSON "type" == "reading"`:                   true,
+		`JSON 'type' == 'reading'`:                   true,
+		`JSON "type" != "reading"`:                   false,
+		`JSON "value" > 20`:                          true,
+		`JSON "value" <= 20`:                         false,
+		`JSON "value" >= -5`:                         true,
+		`JSON "ok"`:                                  true,
+		`!JSON "ok"`:                                 false,
+		`Topic 1 == "bar" && JSON "value" < 30`:      true,
+		`Topic 1 == "foo" || JSON "type" == "other"`: false,
+		`(Topic 0 == "foo" || false) && true`:        true,
+		`FullTopic =~ "^foo/.*/baz$"`:                true,
+		`FullTopic !~ "bar"`:                         false,
+		`JSON "doesnotexist" == "x"`:                 false,
+		`JSON "doesnotexist" != "x"`:                 false,
+	}
+
+	for text, expected := range cases {
+		node, err := parseExpr(text)
+		if err != nil {
+			t.Errorf("Parsing %v: %v", text, err)
+			continue
+		}
+		result := evalCondition(node, &ctx)
+		if result != expected {
+			t.Errorf("Condition %v: expected %v, got %v", text, expected, result)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	payload := `{"voltage": 230, "current": 0.5}`
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar/baz", payload)
+	raw := "300.15"
+	ctx.value = &raw
+
+	cases := map[string]float64{
+		`1 + 2 * 3`:                       7,
+		`(1 + 2) * 3`:                     9,
+		`10 - 4 - 3`:                      3,
+		`-2 * -3`:                         6,
+		`7 % 4`:                           3,
+		`1.5e2 / 3`:                       50,
+		`value - 273.15`:                  27,
+		`JSON "voltage" * JSON "current"`: 115,
+		`abs(-3)`:                         3,
+		`min(3, 1, 2) + max(3, 1, 2)`:     4,
+		`round(2.345, 2)`:                 2.35,
+		`round(2.5)`:                      3,
+		`log(100, 10)`:                    2,
+		`pow(2, 10)`:                      1024,
+		`0.5 * pow(value, 2) + 1`:         45046.01125,
+	}
+
+	for text, expected := range cases {
+		node, err := parseExpr(text)
+		if err != nil {
+			t.Errorf("Parsing %v: %v", text, err)
+			continue
+		}
+		result, err := node.eval(&ctx)
+		if err != nil {
+			t.Errorf("Evaluating %v: %v", text, err)
+			continue
+		}
+		if f, _ := toNumber(result); math.Abs(f-expected) > 1e-9 {
+			t.Errorf("Expression %v: expected %v, got %v", text, expected, result)
+		}
+	}
+
+	errors := []string{
+		`1 / 0`,
+		`1 % 0`,
+		`"foo" + 1`,
+		`log(0)`,
+		`abs(1, 2)`,
+		`pow(-1, 0.5)`,
+		`JSON "doesnotexist" * 2`,
+	}
+	for _, text := range errors {
+		node, err := parseExpr(text)
+		if err != nil {
+			t.Errorf("Parsing %v: %v", text, err)
+			continue
+		}
+		if _, err := node.eval(&ctx); err == nil {
+			t.Errorf("Expected error for %v, got OK", text)
+		}
+	}
+}
+
+func TestConditionSyntaxErrors(t *testing.T) {
+	invalid := []string{
+		``,
+		`JSON "type" ==`,
+		`(Topic 1 == "a"`,
+		`"unterminated`,
+		`Topic 1 == "a" "b"`,
+		`FullTopic =~ Topic 1`,
+		`FullTopic =~ "[invalid"`,
+		`Topic 1 # 2`,
+		`1 +`,
+		`sqrt(4)`,
+		`abs(1`,
+		`max(1 2)`,
+	}
+
+	for _, text := range invalid {
+		_, err := parseExpr(text)
+		if err == nil {
+			t.Errorf("Expected error for %q, got OK", text)
+		}
+	}
+}
+
+func TestSubscriptionCondition(t *testing.T) {
+	s := &Subscription{
+		Measurement: "test",
+		Value:       "JSON \"value\"",
+		When:        "JSON \"type\" == \"reading\"",
+	}
+
+	m, err := s.Read("foo/bar", `{"type": "reading", "value": 5}`)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != 5.0 {
+		t.Errorf("expected 5, got %v", m.Values["value"])
+	}
+
+	_, err = s.Read("foo/bar", `{"type": "status", "value": 5}`)
+	if err != ErrSkipped {
+		t.Errorf("Expected ErrSkipped, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package mqttinflux
+
+// Filters reject invalid values before they are written to InfluxDB,
+// e.g. glitches from cheap sensors.
+//
+// The spike filter compares each value with the recent values
+// of the same series (measurement, tags and field).
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Filter describes valid values for the numeric fields of a measurement.
+//
+// Min, Max: optional, the range of valid values
+// Clamp: optional, limit values to Min and Max instead of dropping them
+// MaxDelta: optional, drop values which deviate more than this
+// from the mean of the recent values
+// MaxStdDev: optional, drop values which deviate more than this many
+// standard deviations from the mean of the recent values
+// Window: number of recent values for the spike filter (default: 10)
+type Filter struct {
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	Clamp     bool     `json:"clamp"`
+	MaxDelta  float64  `json:"maxDelta"`
+	MaxStdDev float64  `json:"maxStdDev"`
+	Window    int      `json:"window"`
+}
+
+const (
+	defaultFilterWindow = 10
+	// minimum number of recent values for the standard deviation
+	minStdDevSamples = 3
+	// lower limit for the standard deviation, relative to the mean,
+	// so that small changes of a steady series are not spikes
+	minRelativeStdDev = 0.01
+	// after this many spikes in a row, the series is assumed to have
+	// changed and the recent values are replaced
+	maxSpikes = 3
+)
+
+func (f *Filter) validate() error {
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return fmt.Errorf("filter min %v is greater than max %v", *f.Min, *f.Max)
+	}
+	if f.Clamp && f.Min == nil && f.Max == nil {
+		return errors.New("filter clamp requires min or max")
+	}
+	if f.MaxDelta < 0 || f.MaxStdDev < 0 {
+		return errors.New("filter maxDelta and maxStdDev must not be negative")
+	}
+	if f.Window < 0 {
+		return fmt.Errorf("invalid filter window %d", f.Window)
+	}
+	return nil
+}
+
+func (f *Filter) spikeFilter() bool {
+	return f.MaxDelta != 0 || f.MaxStdDev != 0
+}
+
+func (f *Filter) window() int {
+	if f.Window == 0 {
+		return defaultFilterWindow
+	}
+	return f.Window
+}
+
+// checkRange applies Min and Max to a value. It returns the value,
+// which may be clamped, and false if the value should be dropped.
+func (f *Filter) checkRange(value interface{}, x float64) (interface{}, bool) {
+	var bound float64
+	var below bool
+	switch {
+	case f.Min != nil && x < *f.Min:
+		bound, below = *f.Min, true
+	case f.Max != nil && x > *f.Max:
+		bound = *f.Max
+	default:
+		return value, true
+	}
+	if !f.Clamp {
+		return nil, false
+	}
+
+	switch value.(type) {
+	case int64, uint64:
+		// round fractional bounds into the range
+		if below {
+			bound = math.Ceil(bound)
+		} else {
+			bound = math.Floor(bound)
+		}
+	}
+
+	// keep the type of the value
+	switch value.(type) {
+	case int64:
+		switch {
+		case bound >= math.MaxInt64:
+			return int64(math.MaxInt64), true
+		case bound <= math.MinInt64:
+			return int64(math.MinInt64), true
+		}
+		return int64(bound), true
+	case uint64:
+		switch {
+		case bound <= 0:
+			return uint64(0), true
+		case bound >= math.MaxUint64:
+			return uint64(math.MaxUint64), true
+		}
+		return uint64(bound), true
+	}
+	return bound, true
+}
+
+// isSpike tells if `x` deviates too much from the recent values.
+func (f *Filter) isSpike(x float64, recent []float64) bool {
+	if len(recent) == 0 {
+		return false
+	}
+
+	var sum float64
+	for _, v := range recent {
+		sum += v
+	}
+	mean := sum / float64(len(recent))
+	deviation := math.Abs(x - mean)
+
+	exceedsDelta := f.MaxDelta == 0 || deviation > f.MaxDelta
+	if f.MaxStdDev == 0 || len(recent) < minStdDevSamples {
+		return f.MaxDelta != 0 && exceedsDelta
+	}
+
+	var squares float64
+	for _, v := range recent {
+		squares += (v - mean) * (v - mean)
+	}
+	stdDev := math.Sqrt(squares / float64(len(recent)))
+	stdDev = math.Max(stdDev, minRelativeStdDev*math.Abs(mean))
+	// with both limits, a spike must exceed both
+	return exceedsDelta && deviation > f.MaxStdDev*stdDev
+}
+
+// seriesHistory holds the recent values of a series
+// and the values which were rejected as spikes.
+type seriesHistory struct {
+	recent []float64
+	spikes []float64
+}
+
+// filterState keeps the history for the spike filter.
+type filterState struct {
+	mutex   sync.Mutex
+	history map[string]*seriesHistory
+}
+
+func newFilterState() *filterState {
+	return &filterState{
+		history: make(map[string]*seriesHistory),
+	}
+}
+
+// accept tells if `x` is a valid value for the series with the given key
+// and updates the history.
+func (st *filterState) accept(key string, x float64, f *Filter) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	h, ok := st.history[key]
+	if !ok {
+		h = &seriesHistory{}
+		st.history[key] = h
+	}
+
+	if f.isSpike(x, h.recent) {
+		h.spikes = append(h.spikes, x)
+		if len(h.spikes) < maxSpikes {
+			return false
+		}
+		h.recent = h.spikes[:len(h.spikes)-1]
+	}
+	h.spikes = nil
+
+	h.recent = append(h.recent, x)
+	if len(h.recent) > f.window() {
+		h.recent = h.recent[len(h.recent)-f.window():]
+	}
+	return true
+}
+
+// seriesKey identifies the series of a measurement,
+// i.e. database, name and tags.
+func seriesKey(m *Measurement) string {
+	var tagNames []string
+	for name := range m.Tags {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
+
+	key := m.Name
+	if m.Database != "" {
+		key = m.Database + "/" + key
+	}
+	for _, name := range tagNames {
+		key += "," + name + "=" + m.Tags[name]
+	}
+	return key
+}
+
+// filterFor returns the filter for a field, either from `Fields`
+// or the filter of the subscription.
+func (s *Subscription) filterFor(field string) *Filter {
+	if f, ok := s.Fields[field]; ok && f.Filter != nil {
+		return f.Filter
+	}
+	return s.Filter
+}
+
+// hasFilters tells if a filter is configured for the subscription
+// or any of its fields.
+func (s *Subscription) hasFilters() bool {
+	if s.Filter != nil {
+		return true
+	}
+	for _, f := range s.Fields {
+		if f.Filter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// applyFilters drops or clamps invalid numeric values.
+// Measurements without any remaining values are dropped.
+func (s *Subscription) applyFilters(measurements []Measurement) []Measurement {
+	if s.filters == nil {
+		return measurements
+	}
+
+	result := measurements[:0]
+	for _, m := range measurements {
+		key := seriesKey(&m)
+		for name, value := range m.Values {
+			f := s.filterFor(name)
+			if f == nil {
+				continue
+			}
+			x, ok := toFloat(value)
+			if !ok {
+				continue
+			}
+
+			value, ok = f.checkRange(value, x)
+			if ok && f.spikeFilter() {
+				x, _ = toFloat(value)
+				ok = s.filters.accept(key+" "+name, x, f)
+			}
+			if !ok {
+				logFilterDropped(key, name, m.Values[name])
+				delete(m.Values, name)
+				continue
+			}
+			m.Values[name] = value
+		}
+		if len(m.Values) != 0 {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// toFloat returns the numeric value of a field value.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func logFilterDropped(series, field string, value interface{}) {
+	LogInfo("Filter dropped %v=%v for %v", field, value, series)
+}
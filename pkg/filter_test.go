@@ -0,0 +1,187 @@
+package mqttinflux
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func readValues(s *Subscription, topic string, payloads []string, t *testing.T) []interface{} {
+	var values []interface{}
+	for _, payload := range payloads {
+		measurements, err := s.ReadAll(topic, payload)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", payload, err)
+		}
+		for _, m := range measurements {
+			values = append(values, m.Values["value"])
+		}
+	}
+	return values
+}
+
+func checkValues(values, expected []interface{}, t *testing.T) {
+	if len(values) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+		return
+	}
+	for i := range values {
+		x, isFloat := values[i].(float64)
+		e, expectFloat := expected[i].(float64)
+		if isFloat && expectFloat {
+			if math.Abs(x-e) > 1e-9 {
+				t.Errorf("Expected %v, got %v", expected, values)
+				return
+			}
+		} else if values[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, values)
+			return
+		}
+	}
+}
+
+func TestFilterRange(t *testing.T) {
+	var s Subscription
+	err := json.Unmarshal([]byte(`{
+		"measurement": "temperature",
+		"conversion": {"kind": "float"},
+		"filter": {"min": -30, "max": 60}
+	}`), &s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	values := readValues(&s, "dht", []string{"21.5", "6553.5", "-40", "60", "-30"}, t)
+	checkValues(values, []interface{}{21.5, 60.0, -30.0}, t)
+
+	s.Filter.Clamp = true
+	values = readValues(&s, "dht", []string{"21.5", "6553.5", "-40"}, t)
+	checkValues(values, []interface{}{21.5, 60.0, -30.0}, t)
+
+	s = Subscription{
+		Measurement: "level",
+		Conversion:  Conversion{Kind: "integer"},
+		Filter:      &Filter{Max: floatPtr(100), Clamp: true},
+	}
+	values = readValues(&s, "tank", []string{"50", "120"}, t)
+	checkValues(values, []interface{}{int64(50), int64(100)}, t)
+	// fractional bounds are rounded into the range
+	s.Filter = &Filter{Min: floatPtr(0.5), Max: floatPtr(99.5), Clamp: true}
+	values = readValues(&s, "tank", []string{"0", "120"}, t)
+	checkValues(values, []interface{}{int64(1), int64(99)}, t)
+}
+
+func TestFilterClampUnsigned(t *testing.T) {
+	s := Subscription{
+		Measurement: "bytes",
+		Conversion:  Conversion{Kind: "unsigned"},
+		Filter:      &Filter{Min: floatPtr(-10), Max: floatPtr(-5), Clamp: true},
+	}
+	values := readValues(&s, "counter", []string{"7"}, t)
+	checkValues(values, []interface{}{uint64(0)}, t)
+
+	s.Filter = &Filter{Min: floatPtr(1.5), Max: floatPtr(1e30), Clamp: true}
+	values = readValues(&s, "counter", []string{"0", "18446744073709551615"}, t)
+	checkValues(values, []interface{}{uint64(2), uint64(18446744073709551615)}, t)
+
+	s.Filter = &Filter{Max: floatPtr(1e19), Clamp: true}
+	values = readValues(&s, "counter", []string{"18446744073709551615"}, t)
+	checkValues(values, []interface{}{uint64(1e19)}, t)
+}
+
+func TestFilterFields(t *testing.T) {
+	s := &Subscription{
+		Measurement: "climate",
+		Filter:      &Filter{Min: floatPtr(-30), Max: floatPtr(60)},
+		Fields: map[string]Field{
+			"temperature": {Value: `JSON "t"`, Conversion: Conversion{Kind: "float"}},
+			"humidity": {
+				Value:      `JSON "h"`,
+				Conversion: Conversion{Kind: "float"},
+				Filter:     &Filter{Min: floatPtr(0), Max: floatPtr(100)},
+			},
+			"state": {Value: `JSON "s"`, Conversion: Conversion{Kind: "string"}},
+		},
+	}
+
+	measurements, err := s.ReadAll("dht", `{"t": 6553.5, "h": 80, "s": "ok"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 {
+		t.Fatalf("Expected one measurement, got %d", len(measurements))
+	}
+	values := measurements[0].Values
+	if _, ok := values["temperature"]; ok {
+		t.Errorf("Expected temperature to be dropped, got %v", values["temperature"])
+	}
+	if values["humidity"] != 80.0 || values["state"] != "ok" {
+		t.Errorf("Unexpected values %v", values)
+	}
+
+	s.Fields = map[string]Field{
+		"temperature": {Value: `JSON "t"`, Conversion: Conversion{Kind: "float"}},
+	}
+	measurements, err = s.ReadAll("dht", `{"t": -40}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 0 {
+		t.Errorf("Expected measurement to be dropped, got %v", measurements)
+	}
+}
+
+func TestFilterSpikes(t *testing.T) {
+	s := &Subscription{
+		Measurement: "temperature",
+		Tags:        map[string]string{"room": "{{.Topic 0}}"},
+		Conversion:  Conversion{Kind: "float"},
+		Filter:      &Filter{MaxDelta: 5, Window: 3},
+	}
+	values := readValues(s, "kitchen", []string{"21", "22", "40", "23", "-5", "22"}, t)
+	checkValues(values, []interface{}{21.0, 22.0, 23.0, 22.0}, t)
+
+	// each series has its own history
+	values = readValues(s, "attic", []string{"40"}, t)
+	checkValues(values, []interface{}{40.0}, t)
+
+	// after repeated spikes, the new level is accepted
+	values = readValues(s, "kitchen", []string{"30", "30.5", "31", "31.5"}, t)
+	checkValues(values, []interface{}{31.0, 31.5}, t)
+
+	s = &Subscription{
+		Measurement: "temperature",
+		Conversion:  Conversion{Kind: "float"},
+		Filter:      &Filter{MaxStdDev: 3},
+	}
+	values = readValues(s, "kitchen", []string{"20", "21", "20", "21", "20.5", "35", "21.5"}, t)
+	checkValues(values, []interface{}{20.0, 21.0, 20.0, 21.0, 20.5, 21.5}, t)
+
+	// a steady series has no deviation, small steps are not spikes
+	values = readValues(s, "attic", []string{"21", "21", "21", "21", "21.1", "21.1", "6553.5"}, t)
+	checkValues(values, []interface{}{21.0, 21.0, 21.0, 21.0, 21.1, 21.1}, t)
+}
+
+func TestFilterValidate(t *testing.T) {
+	invalid := []Filter{
+		{Min: floatPtr(10), Max: floatPtr(0)},
+		{Clamp: true},
+		{MaxDelta: -1},
+		{MaxStdDev: 2, Window: -1},
+	}
+	for _, f := range invalid {
+		s := &Subscription{Filter: &f}
+		if err := s.parseTemplates(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", f)
+		}
+	}
+
+	f := Filter{Clamp: true}
+	s := &Subscription{Fields: map[string]Field{"x": {Value: "Payload", Filter: &f}}}
+	if err := s.parseTemplates(); err == nil {
+		t.Errorf("Expected error for field filter %+v, got OK", f)
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
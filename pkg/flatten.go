@@ -0,0 +1,113 @@
+package mqttinflux
+
+// Flatten nested JSON objects into fields.
+//
+// Each leaf value in the decoded payload is written to a field named after
+// the path to the leaf, e.g.
+//
+//    {"sensor": {"temp": 21.5}, "wifi": {"rssi": -60}, "list": [1, 2]}
+//
+// becomes the fields `sensor.temp`, `wifi.rssi`, `list.0` and `list.1`.
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+)
+
+const defaultSeparator = "."
+
+// Flatten describes how a JSON payload is flattened into fields.
+//
+// Path: optional, JSON path to the object which is flattened
+// Separator: optional, joins the keys for field names (default ".")
+// Include: optional, glob patterns; only matching fields are written
+// Exclude: optional, glob patterns; matching fields and objects are skipped
+// SkipStrings: optional, write only numeric and boolean values
+type Flatten struct {
+	Path        string   `json:"path"`
+	Separator   string   `json:"separator"`
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	SkipStrings bool     `json:"skipStrings"`
+}
+
+// validate checks the separator and the glob patterns.
+func (f *Flatten) validate() error {
+	if invalidNameChars.MatchString(f.Separator) {
+		return fmt.Errorf("invalid separator %q", f.Separator)
+	}
+	for _, patterns := range [][]string{f.Include, f.Exclude} {
+		for _, pattern := range patterns {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flattenFields adds a field to the Measurement for each leaf in `data`.
+func (f *Flatten) flattenFields(m *Measurement, data interface{}) {
+	f.walk(m, "", data)
+}
+
+func (f *Flatten) walk(m *Measurement, name string, value interface{}) {
+	if name != "" && matchAny(f.Exclude, name) {
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, nested := range v {
+			if key = sanitizeName(key); key != "" {
+				f.walk(m, f.join(name, key), nested)
+			}
+		}
+		return
+	case []interface{}:
+		for i, nested := range v {
+			f.walk(m, f.join(name, strconv.Itoa(i)), nested)
+		}
+		return
+	}
+
+	if name == "" || (len(f.Include) != 0 && !matchAny(f.Include, name)) {
+		return
+	}
+
+	switch v := decodedNumber(value).(type) {
+	case float64, bool:
+		m.SetField(name, v)
+	case int64:
+		m.SetField(name, float64(v))
+	case uint64:
+		m.SetField(name, float64(v))
+	case string:
+		if !f.SkipStrings {
+			m.SetField(name, v)
+		}
+	}
+}
+
+func (f *Flatten) join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	separator := f.Separator
+	if separator == "" {
+		separator = defaultSeparator
+	}
+	return prefix + separator + key
+}
+
+// matchAny tells if the name matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
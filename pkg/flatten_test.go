@@ -0,0 +1,106 @@
+package mqttinflux
+
+import (
+	"testing"
+)
+
+const flattenPayload = `{
+	"sensor": {"temp": 21.5, "ok": true, "name": "living room"},
+	"wifi": {"rssi": -60, "ssid": "home"},
+	"list": [1, 2],
+	"empty": null
+}`
+
+func TestFlatten(t *testing.T) {
+	cases := []struct {
+		flatten  Flatten
+		expected map[string]interface{}
+	}{
+		{Flatten{}, map[string]interface{}{
+			"sensor.temp": 21.5,
+			"sensor.ok":   true,
+			"sensor.name": "living room",
+			"wifi.rssi":   -60.0,
+			"wifi.ssid":   "home",
+			"list.0":      1.0,
+			"list.1":      2.0,
+		}},
+		{Flatten{Separator: "_", SkipStrings: true}, map[string]interface{}{
+			"sensor_temp": 21.5,
+			"sensor_ok":   true,
+			"wifi_rssi":   -60.0,
+			"list_0":      1.0,
+			"list_1":      2.0,
+		}},
+		{Flatten{Include: []string{"sensor.*", "wifi.rssi"}, Exclude: []string{"sensor.name"}}, map[string]interface{}{
+			"sensor.temp": 21.5,
+			"sensor.ok":   true,
+			"wifi.rssi":   -60.0,
+		}},
+		{Flatten{Exclude: []string{"sensor", "list"}}, map[string]interface{}{
+			"wifi.rssi": -60.0,
+			"wifi.ssid": "home",
+		}},
+		{Flatten{Path: "sensor"}, map[string]interface{}{
+			"temp": 21.5,
+			"ok":   true,
+			"name": "living room",
+		}},
+	}
+
+	for i, c := range cases {
+		flatten := c.flatten
+		s := &Subscription{Measurement: "test", Flatten: &flatten}
+		m, err := s.Read("foo/bar", flattenPayload)
+		if err != nil {
+			t.Errorf("Case %v: unexpected error: %v", i, err)
+			continue
+		}
+		if len(m.Values) != len(c.expected) {
+			t.Errorf("Case %v: expected %v, got %v", i, c.expected, m.Values)
+		}
+		for name, value := range c.expected {
+			if m.Values[name] != value {
+				t.Errorf("Case %v, field %v: expected %v, got %v", i, name, value, m.Values[name])
+			}
+		}
+	}
+}
+
+func TestFlattenForeach(t *testing.T) {
+	s := &Subscription{
+		Measurement: "test",
+		Foreach:     "sensors",
+		Flatten:     &Flatten{Exclude: []string{"id"}},
+		Tags:        map[string]string{"sensor": "{{.Item \"id\"}}"},
+	}
+
+	payload := `{"sensors": [{"id": "a", "temp": 20}, {"id": "b", "temp": 21}]}`
+	measurements, err := s.ReadAll("foo/bar", payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+	for _, m := range measurements {
+		if len(m.Values) != 1 || m.Values["temp"] == nil {
+			t.Errorf("Unexpected fields %v", m.Values)
+		}
+	}
+}
+
+func TestFlattenInvalid(t *testing.T) {
+	invalid := []Flatten{
+		{Separator: "/"},
+		{Include: []string{"[a"}},
+		{Exclude: []string{"\\"}},
+	}
+	for _, flatten := range invalid {
+		f := flatten
+		s := &Subscription{Flatten: &f}
+		if err := s.parseTemplates(); err == nil {
+			t.Errorf("Expected error for %v, got OK", flatten)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package mqttinflux
+
+// Create subscriptions from Home Assistant MQTT discovery messages.
+// See: https://www.home-assistant.io/docs/mqtt/discovery/
+//
+// Discovery topics have the form:
+//
+//    <prefix>/<component>/[<node_id>/]<object_id>/config
+//
+// The payload is a JSON object with the configuration for the entity.
+// Only `sensor` and `binary_sensor` components are supported.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// abbreviations for discovery keys which are used here
+var haAbbreviations = map[string]string{
+	"stat_t":       "state_topic",
+	"val_tpl":      "value_template",
+	"unit_of_meas": "unit_of_measurement",
+	"dev_cla":      "device_class",
+	"obj_id":       "object_id",
+	"uniq_id":      "unique_id",
+	"pl_on":        "payload_on",
+	"pl_off":       "payload_off",
+	"dev":          "device",
+}
+
+// device classes for sensors which do not have numeric values
+var haNonNumeric = map[string]bool{
+	"date":      true,
+	"enum":      true,
+	"timestamp": true,
+}
+
+// matches `{{ value_json.foo.bar }}` or `{{ value_json['foo'][0] }}`,
+// optionally followed by filters (`| float`) which are ignored
+var haValueJSON = regexp.MustCompile(
+	`^\{\{\s*value_json((?:\.[A-Za-z0-9_]+|\[\s*'[^']*'\s*\]|\[\s*"[^"]*"\s*\]|\[\s*[0-9]+\s*\])+)\s*(\|[^}]*)?\}\}$`)
+
+// matches `{{ value }}`, the plain payload
+var haValue = regexp.MustCompile(`^\{\{\s*value\s*(\|[^}]*)?\}\}$`)
+
+var haPathSegment = regexp.MustCompile(`\.([A-Za-z0-9_]+)|\[\s*'([^']*)'\s*\]|\[\s*"([^"]*)"\s*\]|\[\s*([0-9]+)\s*\]`)
+
+// homeAssistantSubscription creates a Subscription from the discovery
+// message for a Home Assistant entity.
+// Returns ErrSkipped for unsupported components.
+func homeAssistantSubscription(prefix, topic string, payload []byte) (Subscription, error) {
+	var s Subscription
+
+	rel := strings.Split(strings.TrimPrefix(topic, strings.TrimSuffix(prefix, "/")+"/"), "/")
+	if len(rel) < 3 || len(rel) > 4 || rel[len(rel)-1] != "config" {
+		return s, fmt.Errorf("not a discovery topic: %q", topic)
+	}
+	component := rel[0]
+	objectID := rel[len(rel)-2]
+
+	if component != "sensor" && component != "binary_sensor" {
+		return s, ErrSkipped
+	}
+
+	raw := make(map[string]interface{})
+	err := json.Unmarshal(payload, &raw)
+	if err != nil {
+		return s, err
+	}
+	config := expandDiscovery(raw)
+
+	stateTopic := config.str("state_topic")
+	if stateTopic == "" {
+		return s, fmt.Errorf("no state_topic for %q", topic)
+	}
+
+	value, err := haValueTemplate(config.str("value_template"))
+	if err != nil {
+		return s, err
+	}
+
+	deviceClass := config.str("device_class")
+	unit := config.str("unit_of_measurement")
+
+	measurement := deviceClass
+	if measurement == "" {
+		measurement = component
+	}
+
+	s = Subscription{
+		Topic:       stateTopic,
+		Measurement: sanitizeName(measurement),
+		Value:       value,
+		Tags: map[string]string{
+			"entity": sanitizeName(objectID),
+		},
+	}
+
+	if device, ok := config["device"].(map[string]interface{}); ok {
+		if name, ok := device["name"].(string); ok && sanitizeName(name) != "" {
+			s.Tags["device"] = sanitizeName(name)
+		}
+	}
+	if unitTag(unit) != "" {
+		s.Tags["unit"] = unitTag(unit)
+	}
+
+	switch {
+	case component == "binary_sensor":
+		on, off := config.str("payload_on"), config.str("payload_off")
+		if on == "" {
+			on = "ON"
+		}
+		if off == "" {
+			off = "OFF"
+		}
+		s.Conversion = Conversion{
+			Kind:   "boolean",
+			Lookup: map[string]string{on: "true", off: "false"},
+		}
+	case unit != "" || (deviceClass != "" && !haNonNumeric[deviceClass]):
+		s.Conversion = Conversion{Kind: "float"}
+	default:
+		s.Conversion = Conversion{Kind: "string"}
+	}
+
+	return s, nil
+}
+
+// haValueTemplate translates a Home Assistant value template
+// to the `value` of a Subscription.
+// Only templates which select a value from a JSON payload are supported.
+func haValueTemplate(tpl string) (string, error) {
+	tpl = strings.TrimSpace(tpl)
+	if tpl == "" || haValue.MatchString(tpl) {
+		return "", nil
+	}
+
+	groups := haValueJSON.FindStringSubmatch(tpl)
+	if groups == nil {
+		return "", fmt.Errorf("unsupported value_template %q", tpl)
+	}
+
+	var parts []string
+	for _, segment := range haPathSegment.FindAllStringSubmatch(groups[1], -1) {
+		for _, name := range segment[1:] {
+			if name != "" {
+				parts = append(parts, strings.ReplaceAll(name, ".", "\\."))
+				break
+			}
+		}
+	}
+
+	return "JSON " + fmt.Sprintf("%q", strings.Join(parts, ".")), nil
+}
+
+type discoveryConfig map[string]interface{}
+
+// expandDiscovery replaces abbreviated keys and expands the base topic (`~`).
+func expandDiscovery(raw map[string]interface{}) discoveryConfig {
+	base, _ := raw["~"].(string)
+	config := make(discoveryConfig, len(raw))
+	for key, value := range raw {
+		if long, ok := haAbbreviations[key]; ok {
+			key = long
+		}
+		if s, ok := value.(string); ok && base != "" && strings.HasSuffix(key, "_topic") {
+			if strings.HasPrefix(s, "~") {
+				value = base + s[1:]
+			} else if strings.HasSuffix(s, "~") {
+				value = s[:len(s)-1] + base
+			}
+		}
+		config[key] = value
+	}
+	return config
+}
+
+func (c discoveryConfig) str(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
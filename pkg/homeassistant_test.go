@@ -0,0 +1,120 @@
+package mqttinflux
+
+import (
+	"testing"
+)
+
+func TestHomeAssistantSensor(t *testing.T) {
+	payload := `{
+		"~": "home/livingroom",
+		"stat_t": "~/state",
+		"val_tpl": "{{ value_json.temperature | float }}",
+		"unit_of_meas": "°C",
+		"dev_cla": "temperature",
+		"dev": {"name": "Living Room"}
+	}`
+
+	s, err := homeAssistantSubscription("homeassistant", "homeassistant/sensor/lr/temp/config", []byte(payload))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.Topic != "home/livingroom/state" {
+		t.Errorf("Unexpected topic %q", s.Topic)
+	}
+	if s.Measurement != "temperature" {
+		t.Errorf("Unexpected measurement %q", s.Measurement)
+	}
+	if s.Conversion.Kind != "float" {
+		t.Errorf("Unexpected conversion %q", s.Conversion.Kind)
+	}
+
+	expectedTags := map[string]string{
+		"entity": "temp",
+		"device": "Living_Room",
+		"unit":   "C",
+	}
+	for tag, value := range expectedTags {
+		if s.Tags[tag] != value {
+			t.Errorf("Tag %v: expected %q, got %q", tag, value, s.Tags[tag])
+		}
+	}
+
+	err = s.parseTemplates()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := s.Read("home/livingroom/state", `{"temperature": 21.5}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != 21.5 {
+		t.Errorf("Expected 21.5, got %v", m.Values["value"])
+	}
+}
+
+func TestHomeAssistantBinarySensor(t *testing.T) {
+	payload := `{"state_topic": "door/state", "payload_on": "open", "payload_off": "closed"}`
+	s, err := homeAssistantSubscription("homeassistant", "homeassistant/binary_sensor/door/config", []byte(payload))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.Measurement != "binary_sensor" {
+		t.Errorf("Unexpected measurement %q", s.Measurement)
+	}
+
+	err = s.parseTemplates()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := s.Read("door/state", "open")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != true {
+		t.Errorf("Expected true, got %v", m.Values["value"])
+	}
+}
+
+func TestHomeAssistantSkipped(t *testing.T) {
+	_, err := homeAssistantSubscription("homeassistant", "homeassistant/light/lamp/config", []byte(`{}`))
+	if err != ErrSkipped {
+		t.Errorf("Expected ErrSkipped, got %v", err)
+	}
+
+	invalid := map[string]string{
+		"homeassistant/sensor/config":         `{"state_topic": "a"}`,
+		"homeassistant/sensor/a/b/c/config":   `{"state_topic": "a"}`,
+		"homeassistant/sensor/temp/config":    `{"val_tpl": "{{ value }}"}`,
+		"homeassistant/sensor/temp2/config":   `not json`,
+		"homeassistant/sensor/temp3/config":   `{"state_topic": "a", "value_template": "{{ value | int * 2 }}x"}`,
+		"homeassistant/sensor/temp4/config":   `{"state_topic": "a", "value_template": "{% if value %}1{% endif %}"}`,
+		"homeassistant/sensor/temp5/settings": `{"state_topic": "a"}`,
+	}
+	for topic, payload := range invalid {
+		_, err = homeAssistantSubscription("homeassistant", topic, []byte(payload))
+		if err == nil || err == ErrSkipped {
+			t.Errorf("Expected error for %v, got %v", topic, err)
+		}
+	}
+}
+
+func TestHomeAssistantValueTemplate(t *testing.T) {
+	cases := map[string]string{
+		"":                                    "",
+		"{{ value }}":                         "",
+		"{{value | float}}":                   "",
+		"{{ value_json.temp }}":               `JSON "temp"`,
+		"{{ value_json['a.b'].c }}":           `JSON "a\\.b.c"`,
+		"{{ value_json.data[0] | round(1) }}": `JSON "data.0"`,
+		`{{ value_json["x"]["y"] }}`:          `JSON "x.y"`,
+	}
+
+	for tpl, expected := range cases {
+		result, err := haValueTemplate(tpl)
+		if err != nil {
+			t.Errorf("Template %q: %v", tpl, err)
+		} else if result != expected {
+			t.Errorf("Template %q: expected %q, got %q", tpl, expected, result)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mqttinflux
+
+// Auto-discovery for devices which follow the Homie convention.
+// See: https://homieiot.github.io/specification/
+//
+// Topics have the form:
+//
+//    homie/<device>/<node>/<property>               the property value
+//    homie/<device>/<node>/<property>/$datatype     attributes of the property
+//                                                   ($name, $datatype, $unit)
+//    homie/<device>/<node>/<property>/set           commands (ignored)
+//    homie/<device>/$attribute                      device attributes (ignored)
+//    homie/<device>/<node>/$attribute               node attributes (ignored)
+
+import (
+	"strings"
+	"sync"
+)
+
+const modeHomie = "homie"
+
+// homieProperty holds the metadata for a Homie property.
+type homieProperty struct {
+	name     string
+	datatype string
+	unit     string
+}
+
+// homieState keeps the metadata learned from `$` attributes
+// for each property, the key is "<device>/<node>/<property>".
+type homieState struct {
+	mutex      sync.Mutex
+	properties map[string]*homieProperty
+}
+
+func newHomieState() *homieState {
+	return &homieState{
+		properties: make(map[string]*homieProperty),
+	}
+}
+
+// homieSubscription creates the subscription for Homie auto-discovery.
+func homieSubscription(baseTopic string) Subscription {
+	return Subscription{
+		Topic: strings.TrimSuffix(baseTopic, "/") + "/#",
+		Mode:  modeHomie,
+	}
+}
+
+// readHomie learns metadata from attribute messages and creates
+// a Measurement for property values.
+func (s *Subscription) readHomie(ctx TemplateContext) ([]Measurement, error) {
+	base := strings.Split(strings.TrimSuffix(s.Topic, "/#"), "/")
+	if len(ctx.Parts) <= len(base) {
+		return nil, nil
+	}
+	rel := ctx.Parts[len(base):]
+
+	switch {
+	case len(rel) == 4 && strings.HasPrefix(rel[3], "$"):
+		key := strings.Join(rel[:3], "/")
+		s.homie.learn(key, rel[3], ctx.Payload)
+		return nil, nil
+
+	case len(rel) == 3 && !isHomieAttribute(rel):
+		m, err := s.readHomieProperty(ctx, rel[0], rel[1], rel[2])
+		if err == ErrSkipped {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return []Measurement{m}, nil
+	}
+
+	// device and node attributes, commands
+	return nil, nil
+}
+
+func isHomieAttribute(parts []string) bool {
+	for _, part := range parts {
+		if strings.HasPrefix(part, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscription) readHomieProperty(ctx TemplateContext, device, node, property string) (Measurement, error) {
+	var m Measurement
+
+	// an empty value means the property was removed
+	if ctx.Payload == "" {
+		return m, ErrSkipped
+	}
+
+	meta := s.homie.lookup(device + "/" + node + "/" + property)
+	ctx.item = &foreachItem{key: property, value: ctx.Payload}
+	if !s.matches(ctx) {
+		return m, ErrSkipped
+	}
+
+	measurementName := sanitizeName(property)
+	if s.Measurement != "" {
+		var err error
+		measurementName, err = s.fillTemplate("measurement", ctx)
+		if err != nil {
+			return m, err
+		}
+	}
+	m = NewMeasurement(s.Database, measurementName)
+
+	conversion := s.Conversion
+	if !conversion.configured() {
+		conversion = homieConversion(meta.datatype)
+	}
+	value, err := conversion.withContext(ctx).Convert(ctx.Payload)
+	if err != nil {
+		return m, err
+	}
+	m.SetValue(value)
+
+	m.Tag("device", device)
+	m.Tag("node", node)
+	if unit := unitTag(meta.unit); unit != "" {
+		m.Tag("unit", unit)
+	}
+	if name := sanitizeName(meta.name); name != "" {
+		m.Tag("name", name)
+	}
+	tags, err := s.fillTags(ctx)
+	if err != nil {
+		return m, err
+	}
+	for tag, tagValue := range tags {
+		m.Tag(tag, tagValue)
+	}
+
+	return m, nil
+}
+
+// unitTag returns a tag value for a unit, e.g. "°C" becomes "C".
+func unitTag(unit string) string {
+	if unit == "%" {
+		return "percent"
+	}
+	return sanitizeName(unit)
+}
+
+// homieConversion returns the conversion for a Homie datatype.
+// Properties without a datatype are strings.
+func homieConversion(datatype string) Conversion {
+	switch datatype {
+	case "integer":
+		return Conversion{Kind: "integer"}
+	case "float":
+		return Conversion{Kind: "float"}
+	case "boolean":
+		return Conversion{Kind: "boolean"}
+	}
+	// string, enum, color, datetime, duration
+	return Conversion{Kind: "string"}
+}
+
+func (h *homieState) learn(key, attribute, value string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	p, ok := h.properties[key]
+	if !ok {
+		p = &homieProperty{}
+		h.properties[key] = p
+	}
+
+	switch attribute {
+	case "$name":
+		p.name = value
+	case "$datatype":
+		p.datatype = value
+	case "$unit":
+		p.unit = value
+	}
+}
+
+func (h *homieState) lookup(key string) homieProperty {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if p, ok := h.properties[key]; ok {
+		return *p
+	}
+	return homieProperty{}
+}
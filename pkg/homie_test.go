@@ -0,0 +1,102 @@
+package mqttinflux
+
+import (
+	"testing"
+)
+
+func TestHomie(t *testing.T) {
+	s := homieSubscription("homie/")
+	if s.Topic != "homie/#" {
+		t.Errorf("Unexpected topic %q", s.Topic)
+	}
+
+	messages := [][2]string{
+		{"homie/kitchen/$name", "Kitchen"},
+		{"homie/kitchen/sensor/$name", "Sensor"},
+		{"homie/kitchen/sensor/temperature/$name", "Room Temperature"},
+		{"homie/kitchen/sensor/temperature/$datatype", "float"},
+		{"homie/kitchen/sensor/temperature/$unit", "°C"},
+		{"homie/kitchen/sensor/humidity/$datatype", "integer"},
+		{"homie/kitchen/sensor/humidity/$unit", "%"},
+		{"homie/kitchen/light/power/$datatype", "boolean"},
+		{"homie/kitchen/light/power/set", "true"},
+	}
+	for _, msg := range messages {
+		measurements, err := s.ReadAll(msg[0], msg[1])
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %v", msg[0], err)
+		}
+		if len(measurements) != 0 {
+			t.Errorf("Expected no measurements for %v, got %v", msg[0], measurements)
+		}
+	}
+
+	cases := map[string]struct {
+		payload string
+		value   interface{}
+		unit    string
+	}{
+		"homie/kitchen/sensor/temperature": {"21.5", 21.5, "C"},
+		"homie/kitchen/sensor/humidity":    {"40", int64(40), "percent"},
+		"homie/kitchen/light/power":        {"true", true, ""},
+		"homie/kitchen/light/mode":         {"party", "party", ""},
+	}
+	for topic, c := range cases {
+		measurements, err := s.ReadAll(topic, c.payload)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", topic, err)
+			continue
+		}
+		if len(measurements) != 1 {
+			t.Errorf("Expected 1 measurement for %v, got %v", topic, len(measurements))
+			continue
+		}
+
+		m := measurements[0]
+		if m.Values["value"] != c.value {
+			t.Errorf("%v: expected %v, got %v", topic, c.value, m.Values["value"])
+		}
+		if m.Tags["unit"] != c.unit {
+			t.Errorf("%v: expected unit %q, got %q", topic, c.unit, m.Tags["unit"])
+		}
+		if m.Tags["device"] != "kitchen" {
+			t.Errorf("%v: unexpected tags %v", topic, m.Tags)
+		}
+	}
+
+	measurements, err := s.ReadAll("homie/kitchen/sensor/temperature", "22")
+	if err != nil || len(measurements) != 1 {
+		t.Fatalf("Unexpected result %v, %v", measurements, err)
+	}
+	if name := measurements[0].Tags["name"]; name != "Room_Temperature" {
+		t.Errorf("Expected name tag from $name, got %q", name)
+	}
+
+	// invalid value for the datatype
+	_, err = s.ReadAll("homie/kitchen/sensor/humidity", "forty")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestHomieSharedState(t *testing.T) {
+	s := homieSubscription("homie")
+	err := s.parseTemplates()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// e.g. the copy for the MQTT handler and the copy after a reconnect
+	first, second := s, s
+	_, err = first.ReadAll("homie/kitchen/sensor/humidity/$datatype", "integer")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	measurements, err := second.ReadAll("homie/kitchen/sensor/humidity", "40")
+	if err != nil || len(measurements) != 1 {
+		t.Fatalf("Unexpected result %v, %v", measurements, err)
+	}
+	if value := measurements[0].Values["value"]; value != int64(40) {
+		t.Errorf("Expected integer from the learned datatype, got %T %v", value, value)
+	}
+}
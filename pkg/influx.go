@@ -2,8 +2,11 @@ package mqttinflux
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -13,6 +16,9 @@ var (
 	fieldPattern       = regexp.MustCompile("^[a-zA-Z0-9\\-_\\.]+$")
 	tagPattern         = regexp.MustCompile("^[a-zA-Z0-9\\-_\\.]+$")
 	tagValuePattern    = regexp.MustCompile("^[a-zA-Z0-9:;\\-_\\.]+$")
+	// tags of points from line protocol, anything but line breaks
+	// and a trailing backslash, which would escape the separator
+	escapedTagPattern = regexp.MustCompile("^[^\\n]*[^\\n\\\\]$")
 )
 
 // InfluxService represents an InfluxDB instance.
@@ -87,7 +93,7 @@ func (ifx *InfluxService) send(m *Measurement) error {
 	}
 	url := fmt.Sprintf("%v?db=%v", ifx.url, dbName)
 
-	body := strings.NewReader(m.Format() + "\n")
+	body := strings.NewReader(formatLine(m) + "\n")
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
 		return err
@@ -104,7 +110,79 @@ func (ifx *InfluxService) send(m *Measurement) error {
 	}
 
 	return fmt.Errorf("got HTTP status %v for DB=%q, req=&%q",
-		res.Status, dbName, m.Format())
+		res.Status, dbName, formatLine(m))
+}
+
+// formatLine returns the "Line Protocol" representation for a measurement.
+// See: https://docs.influxdata.com/influxdb/v1.5/write_protocols/line_protocol_reference/
+func formatLine(m *Measurement) string {
+	// pattern:
+	// <measurement>[,<tag_key>=<tag_value>[,<tag_key>=<tag_value>]] <field_key>=<field_value>[,<field_key>=<field_value>] [<timestamp>]
+
+	// <measurement>
+	s := measurementEscaper.Replace(m.Name)
+
+	// sorted tags (for performance on recevier side)
+	var tagNames []string
+	for tagName := range m.Tags {
+		tagNames = append(tagNames, tagName)
+	}
+	sort.Strings(tagNames)
+
+	// ,<tag_key>=<tag_value>
+	for _, tagName := range tagNames {
+		tagValue := m.Tags[tagName]
+		s += fmt.Sprintf(",%v=%v", nameEscaper.Replace(tagName), nameEscaper.Replace(tagValue))
+	}
+
+	// <field_key>=<field_value>[,<field_key>=<field_value>]
+	var fieldNames []string
+	for fieldName := range m.Values {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	s += " "
+	for i, fieldName := range fieldNames {
+		if i > 0 {
+			s += ","
+		}
+		s += nameEscaper.Replace(fieldName) + "=" + formatFieldValue(m.Values[fieldName])
+	}
+
+	//[ <timestamp>]
+	s += fmt.Sprintf(" %d", m.Timestamp.UnixNano())
+	return s
+}
+
+// formatFieldValue returns the line protocol representation of a field value:
+//
+// float:   any numerical value, e.g. 1.5 or 2
+// integer: append 'i', e.g. 123i
+// unsigned: append 'u', e.g. 123u
+// boolean: true|false
+// string:  double quotes, escape quotes and backslashes: "foo \"bar\" baz"
+func formatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		if v == 0 {
+			// special case '-0.0' to '0'
+			return "0"
+		}
+		if math.Abs(v) >= 1e21 {
+			return strconv.FormatFloat(v, 'e', -1, 64)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return "\"" + fieldStringEscaper.Replace(v) + "\""
+	}
+	return fmt.Sprintf("%v", value)
 }
 
 // Logging --------------------------------------------------------------------
@@ -0,0 +1,62 @@
+package mqttinflux
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFormatFieldValue(t *testing.T) {
+	cases := map[string]interface{}{
+		"1.5":                   1.5,
+		"2":                     2.0,
+		"0":                     math.Copysign(0, -1),
+		"1e+21":                 1e21,
+		"12i":                   int64(12),
+		"-3i":                   int64(-3),
+		"18446744073709551615u": uint64(math.MaxUint64),
+		"true":                  true,
+		`"foo"`:                 "foo",
+		`"a \"b\" c\\d"`:        `a "b" c\d`,
+	}
+
+	for expected, value := range cases {
+		result := formatFieldValue(value)
+		if result != expected {
+			t.Errorf("Formatting %v: expected %v, got %v", value, expected, result)
+		}
+	}
+}
+
+func TestFormatLine(t *testing.T) {
+	m := NewMeasurement("db", "m")
+	m.Tag("b", "2")
+	m.Tag("a", "1")
+	m.SetField("value", 1.5)
+	m.SetField("count", int64(3))
+	m.SetField("name", "foo")
+	m.Timestamp = time.Unix(1, 0)
+
+	expected := `m,a=1,b=2 count=3i,name="foo",value=1.5 1000000000`
+	if line := formatLine(&m); line != expected {
+		t.Errorf("Expected %v, got %v", expected, line)
+	}
+}
+
+func TestValidateFieldValue(t *testing.T) {
+	invalid := []interface{}{
+		math.NaN(),
+		math.Inf(1),
+		float32(1.5),
+		[]string{"foo"},
+		nil,
+	}
+
+	for _, value := range invalid {
+		m := NewMeasurement("db", "m")
+		m.SetValue(value)
+		if err := m.Validate(); err == nil {
+			t.Errorf("Expected error for %v, got OK", value)
+		}
+	}
+}
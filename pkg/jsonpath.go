@@ -0,0 +1,477 @@
+package mqttinflux
+
+// A subset of JSONPath to select values from decoded JSON documents.
+// See: https://goessner.net/articles/JsonPath/
+//
+// Supported:
+//
+//    $                 the root element
+//    .name or ['name'] child by name, use brackets for names with dots etc.
+//    [n]               array element, negative indices count from the end
+//    .* or [*]         all children of an object or array
+//    ..name            recursive descent, all descendants with the name
+//    [?(filter)]       children for which the filter holds
+//
+// Filters compare a path relative to the current element (`@`) with a
+// literal value, e.g. `[?(@.id == "a")]` or `[?(@.value > 10)]`.
+// A path without comparison tests for existence: `[?(@.value)]`.
+// Clauses can be combined with `&&` and `||` (`&&` binds stronger).
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type stepKind int
+
+const (
+	stepChild stepKind = iota
+	stepIndex
+	stepWildcard
+	stepDescend
+	stepFilter
+)
+
+type pathStep struct {
+	kind   stepKind
+	name   string
+	index  int
+	filter [][]filterClause // OR of AND-ed clauses
+}
+
+type filterClause struct {
+	path  []pathStep
+	op    string
+	value interface{}
+}
+
+// isJSONPath reports whether `path` should be handled as JSONPath
+// rather than a dotted jsonq path.
+func isJSONPath(path string) bool {
+	return strings.HasPrefix(path, "$")
+}
+
+// queryJSONPath selects all values matching `path` from `doc`.
+func queryJSONPath(doc interface{}, path string) ([]interface{}, error) {
+	steps, err := cachedJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return applySteps([]interface{}{doc}, steps), nil
+}
+
+// parsed JSONPaths for templates and `Foreach`, by path
+var (
+	jsonPathCache      = make(map[string][]pathStep)
+	jsonPathCacheMutex sync.Mutex
+)
+
+// cachedJSONPath parses a JSONPath or returns it from the cache.
+func cachedJSONPath(path string) ([]pathStep, error) {
+	jsonPathCacheMutex.Lock()
+	defer jsonPathCacheMutex.Unlock()
+
+	if steps, ok := jsonPathCache[path]; ok {
+		return steps, nil
+	}
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	jsonPathCache[path] = steps
+	return steps, nil
+}
+
+func parseJSONPath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with '$'", path)
+	}
+	steps, rest, err := parseSteps(path[1:], false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %q: %v", path, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid JSONPath %q: unexpected %q", path, rest)
+	}
+	return steps, nil
+}
+
+// parseSteps reads path steps from `s`. In a filter (`inFilter`), parsing
+// stops at the first character which can not be part of the path.
+func parseSteps(s string, inFilter bool) ([]pathStep, string, error) {
+	var steps []pathStep
+	for s != "" {
+		switch {
+		case strings.HasPrefix(s, ".."):
+			name, rest := readName(s[2:])
+			if name == "" {
+				return nil, s, errors.New("missing name after '..'")
+			}
+			steps = append(steps, pathStep{kind: stepDescend})
+			steps = append(steps, nameStep(name))
+			s = rest
+
+		case s[0] == '.':
+			name, rest := readName(s[1:])
+			if name == "" {
+				return nil, s, errors.New("missing name after '.'")
+			}
+			steps = append(steps, nameStep(name))
+			s = rest
+
+		case s[0] == '[':
+			end := closingBracket(s)
+			if end < 0 {
+				return nil, s, errors.New("missing ']'")
+			}
+			step, err := parseBracket(strings.TrimSpace(s[1:end]))
+			if err != nil {
+				return nil, s, err
+			}
+			steps = append(steps, step)
+			s = s[end+1:]
+
+		default:
+			if inFilter {
+				return steps, s, nil
+			}
+			return nil, s, fmt.Errorf("unexpected %q", s)
+		}
+	}
+	return steps, s, nil
+}
+
+func nameStep(name string) pathStep {
+	if name == "*" {
+		return pathStep{kind: stepWildcard}
+	}
+	return pathStep{kind: stepChild, name: name}
+}
+
+// readName reads a plain member name, up to the next '.' or '['.
+func readName(s string) (string, string) {
+	if strings.HasPrefix(s, "*") {
+		return "*", s[1:]
+	}
+	end := 0
+	for end < len(s) {
+		c := s[end]
+		if c == '.' || c == '[' || c == ' ' || c == ')' || strings.ContainsRune("=!<>&|", rune(c)) {
+			break
+		}
+		end++
+	}
+	return s[:end], s[end:]
+}
+
+// closingBracket finds the index of the ']' matching the '[' at s[0],
+// ignoring brackets inside of quotes and nested brackets.
+func closingBracket(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseBracket(inner string) (pathStep, error) {
+	switch {
+	case inner == "*":
+		return pathStep{kind: stepWildcard}, nil
+
+	case strings.HasPrefix(inner, "'") || strings.HasPrefix(inner, "\""):
+		name, err := unquote(inner)
+		if err != nil {
+			return pathStep{}, fmt.Errorf("invalid name %v", inner)
+		}
+		return pathStep{kind: stepChild, name: name}, nil
+
+	case strings.HasPrefix(inner, "?(") && strings.HasSuffix(inner, ")"):
+		filter, err := parseFilter(inner[2 : len(inner)-1])
+		if err != nil {
+			return pathStep{}, err
+		}
+		return pathStep{kind: stepFilter, filter: filter}, nil
+	}
+
+	index, err := strconv.Atoi(inner)
+	if err != nil {
+		return pathStep{}, fmt.Errorf("invalid index %q", inner)
+	}
+	return pathStep{kind: stepIndex, index: index}, nil
+}
+
+func parseFilter(text string) ([][]filterClause, error) {
+	var filter [][]filterClause
+	for _, alternative := range splitOutsideQuotes(text, "||") {
+		var clauses []filterClause
+		for _, part := range splitOutsideQuotes(alternative, "&&") {
+			clause, err := parseClause(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, clause)
+		}
+		filter = append(filter, clauses)
+	}
+	return filter, nil
+}
+
+func parseClause(text string) (filterClause, error) {
+	var clause filterClause
+	if !strings.HasPrefix(text, "@") {
+		return clause, fmt.Errorf("filter %q must start with '@'", text)
+	}
+
+	steps, rest, err := parseSteps(text[1:], true)
+	if err != nil {
+		return clause, err
+	}
+	clause.path = steps
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		// test for existence
+		return clause, nil
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(rest, op) {
+			clause.op = op
+			rest = strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if clause.op == "" {
+		return clause, fmt.Errorf("invalid filter %q", text)
+	}
+
+	clause.value, err = parseLiteral(rest)
+	return clause, err
+}
+
+// parseLiteral reads a string, number, boolean or null literal.
+func parseLiteral(text string) (interface{}, error) {
+	switch text {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+
+	if strings.HasPrefix(text, "'") || strings.HasPrefix(text, "\"") {
+		return unquote(text)
+	}
+
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q in filter", text)
+	}
+	return f, nil
+}
+
+// splitOutsideQuotes splits `s` at each `sep` which is not inside quotes.
+func splitOutsideQuotes(s, sep string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		} else if c == '\'' || c == '"' {
+			quote = c
+		} else if strings.HasPrefix(s[i:], sep) {
+			parts = append(parts, s[start:i])
+			i += len(sep) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Evaluation -----------------------------------------------------------------
+
+func applySteps(nodes []interface{}, steps []pathStep) []interface{} {
+	for _, step := range steps {
+		var next []interface{}
+		for _, node := range nodes {
+			next = append(next, applyStep(node, step)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func applyStep(node interface{}, step pathStep) []interface{} {
+	switch step.kind {
+	case stepChild:
+		if obj, ok := node.(map[string]interface{}); ok {
+			if value, found := obj[step.name]; found {
+				return []interface{}{value}
+			}
+		}
+
+	case stepIndex:
+		if arr, ok := node.([]interface{}); ok {
+			index := step.index
+			if index < 0 {
+				index += len(arr)
+			}
+			if index >= 0 && index < len(arr) {
+				return []interface{}{arr[index]}
+			}
+		}
+
+	case stepWildcard:
+		return children(node)
+
+	case stepDescend:
+		return descendants(node)
+
+	case stepFilter:
+		var matches []interface{}
+		for _, child := range children(node) {
+			if filterHolds(child, step.filter) {
+				matches = append(matches, child)
+			}
+		}
+		return matches
+	}
+	return nil
+}
+
+// children returns the elements of an array or the values of an object,
+// sorted by key.
+func children(node interface{}) []interface{} {
+	switch v := node.(type) {
+	case []interface{}:
+		return v
+	case map[string]interface{}:
+		keys := sortedKeys(v)
+		result := make([]interface{}, len(keys))
+		for i, key := range keys {
+			result[i] = v[key]
+		}
+		return result
+	}
+	return nil
+}
+
+// descendants returns `node` and all nested values, depth first.
+func descendants(node interface{}) []interface{} {
+	result := []interface{}{node}
+	for _, child := range children(node) {
+		result = append(result, descendants(child)...)
+	}
+	return result
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func filterHolds(node interface{}, filter [][]filterClause) bool {
+	for _, clauses := range filter {
+		holds := true
+		for _, clause := range clauses {
+			if !clause.holds(node) {
+				holds = false
+				break
+			}
+		}
+		if holds {
+			return true
+		}
+	}
+	return false
+}
+
+func (c filterClause) holds(node interface{}) bool {
+	values := applySteps([]interface{}{node}, c.path)
+	if c.op == "" {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		if compareJSON(value, c.op, c.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareJSON(a interface{}, op string, b interface{}) bool {
+	var cmp int
+	switch av := decodedNumber(a).(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return op == "!="
+		}
+		if av < bv {
+			cmp = -1
+		} else if av > bv {
+			cmp = 1
+		}
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return op == "!="
+		}
+		cmp = strings.Compare(av, bv)
+	default:
+		// booleans, null, objects and arrays only support (in)equality
+		equal := fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+		return (op == "==" && equal) || (op == "!=" && !equal)
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package mqttinflux
+
+import (
+	"testing"
+)
+
+const jsonPathPayload = `{
+  "device": {"name": "gw-1", "fw.version": "1.2"},
+  "sensors": [
+    {"id": "a", "value": 21.5, "ok": true},
+    {"id": "b", "value": 40, "ok": false},
+    {"id": "c", "value": 7, "nested": {"value": 99}}
+  ]
+}`
+
+func TestJSONPath(t *testing.T) {
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar", jsonPathPayload)
+
+	cases := map[string]string{
+		`$.device.name`:                            "gw-1",
+		`$['device']['fw.version']`:                "1.2",
+		`$.device["fw.version"]`:                   "1.2",
+		`$.sensors[1].id`:                          "b",
+		`$.sensors[-1].id`:                         "c",
+		`$.sensors[*].id`:                          "a",
+		`$.sensors[?(@.id=="b")].value`:            "40",
+		`$.sensors[?(@.id == 'c')].value`:          "7",
+		`$.sensors[?(@.value > 30)].id`:            "b",
+		`$.sensors[?(@.ok == false)].id`:           "b",
+		`$.sensors[?(@.nested)].id`:                "c",
+		`$.sensors[?(@.id=="x" || @.value<10)].id`: "c",
+		`$.sensors[?(@.ok && @.value>20)].id`:      "a",
+		`$..nested.value`:                          "99",
+		`$.device.*`:                               "1.2",
+	}
+
+	for path, expected := range cases {
+		result, err := ctx.JSON(path)
+		if err != nil {
+			t.Errorf("Path %v: %v", path, err)
+		} else if result != expected {
+			t.Errorf("Path %v: expected %q, got %q", path, expected, result)
+		}
+	}
+
+	// escaped dots in jsonq paths
+	result, err := ctx.JSON(`device.fw\.version`)
+	if err != nil || result != "1.2" {
+		t.Errorf("Expected %q, got %q (%v)", "1.2", result, err)
+	}
+}
+
+func TestJSONPathMultiple(t *testing.T) {
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar", jsonPathPayload)
+	doc, err := ctx.document()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := queryJSONPath(doc, "$..value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 4 {
+		t.Errorf("Expected 4 values, got %v", values)
+	}
+
+	// the path is parsed once
+	jsonPathCacheMutex.Lock()
+	_, cached := jsonPathCache["$..value"]
+	jsonPathCacheMutex.Unlock()
+	if !cached {
+		t.Error("Expected parsed path in cache")
+	}
+}
+
+func TestJSONPathErrors(t *testing.T) {
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar", jsonPathPayload)
+
+	invalid := []string{
+		`$.sensors[`,
+		`$.sensors[x]`,
+		`$.sensors[?(id == "a")]`,
+		`$.sensors[?(@.id ~ "a")]`,
+		`$.sensors[?(@.id == a)]`,
+		`$.`,
+		`$..`,
+		// no match
+		`$.doesnotexist`,
+		`$.sensors[5]`,
+		`$.sensors[?(@.id == "x")]`,
+	}
+
+	for _, path := range invalid {
+		_, err := ctx.JSON(path)
+		if err == nil {
+			t.Errorf("Expected error for %v, got OK", path)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package mqttinflux
+
+// Parse InfluxDB line protocol from MQTT payloads.
+// See: https://docs.influxdata.com/influxdb/v1.8/write_protocols/line_protocol_reference/
+//
+//    <measurement>[,<tag_key>=<tag_value>...] <field_key>=<field_value>[,...] [<timestamp>]
+//
+// Measurement names, tag keys, tag values and field keys escape commas,
+// spaces and equal signs with a backslash.
+// String field values are enclosed in double quotes.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const modeLineProtocol = "lineprotocol"
+
+// escaping in string field values
+var (
+	fieldStringEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	fieldStringUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+)
+
+// escaping in measurement names, tag keys, tag values and field keys;
+// measurement names do not escape equal signs
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	nameEscaper        = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+var fieldValuePattern = regexp.MustCompile(
+	`^(-?[0-9]+i|[0-9]+u|[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?|t|T|true|True|TRUE|f|F|false|False|FALSE|"(?s:.*)")$`)
+
+// readLineProtocol reads all points from a line protocol payload.
+// Tags from the subscription are added to each point and override tags
+// with the same name.
+func (s *Subscription) readLineProtocol(ctx TemplateContext) ([]Measurement, error) {
+	if !s.matches(ctx) {
+		return nil, nil
+	}
+
+	tags, err := s.fillTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	precision := s.TimestampPrecision
+	if precision == "" {
+		precision = "ns"
+	}
+
+	measurements, err := parseLineProtocol(ctx.Payload, precision)
+
+	for i := range measurements {
+		m := &measurements[i]
+		m.Database = s.Database
+		for tag, tagValue := range tags {
+			m.Tag(tag, tagValue)
+		}
+	}
+
+	return measurements, err
+}
+
+// parseLineProtocol reads one point from each non-empty line in `payload`.
+// Lines starting with `#` are ignored.
+// Lines which cannot be read are skipped and the first error is returned
+// along with the points that were read successfully.
+func parseLineProtocol(payload, precision string) ([]Measurement, error) {
+	var firstErr error
+	var measurements []Measurement
+	for number, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parseLine(line, precision)
+		if err == nil {
+			err = m.Validate()
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d: %v", number+1, err)
+			}
+			continue
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, firstErr
+}
+
+func parseLine(line, precision string) (Measurement, error) {
+	name, rest := scanLine(line, ", ", false)
+	m := NewMeasurement("", unescapeName(name))
+	m.escapedTags = true
+	if name == "" {
+		return m, errors.New("missing measurement name")
+	}
+
+	// tags
+	for strings.HasPrefix(rest, ",") {
+		var pair string
+		pair, rest = scanLine(rest[1:], ", ", false)
+		key, value, err := splitPair(pair)
+		if err != nil {
+			return m, err
+		}
+		m.Tag(unescapeName(key), unescapeName(value))
+	}
+
+	// fields
+	rest = strings.TrimLeft(rest, " ")
+	fieldSet, rest := scanLine(rest, " ", true)
+	if fieldSet == "" {
+		return m, errors.New("missing fields")
+	}
+	for fieldSet != "" {
+		var pair string
+		pair, fieldSet = scanLine(fieldSet, ",", true)
+		fieldSet = strings.TrimPrefix(fieldSet, ",")
+
+		key, value, err := splitPair(pair)
+		if err != nil {
+			return m, err
+		}
+		fieldValue, err := parseFieldValue(value)
+		if err != nil {
+			return m, fmt.Errorf("invalid value for field %q: %v", key, value)
+		}
+		m.SetField(unescapeName(key), fieldValue)
+	}
+
+	// optional timestamp
+	rest = strings.TrimSpace(rest)
+	if rest != "" {
+		ts, err := parseTimestamp(rest, precision)
+		if err != nil {
+			return m, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		m.Timestamp = ts
+	}
+
+	return m, nil
+}
+
+// parseFieldValue reads a typed field value in line protocol format.
+func parseFieldValue(value string) (interface{}, error) {
+	if !fieldValuePattern.MatchString(value) {
+		return nil, fmt.Errorf("invalid field value %q", value)
+	}
+
+	switch {
+	case strings.HasPrefix(value, "\""):
+		return fieldStringUnescaper.Replace(value[1 : len(value)-1]), nil
+	case strings.HasSuffix(value, "i"):
+		return strconv.ParseInt(value[:len(value)-1], 10, 64)
+	case strings.HasSuffix(value, "u"):
+		return strconv.ParseUint(value[:len(value)-1], 10, 64)
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// scanLine reads from `s` up to the first unescaped character from `stops`
+// and returns the text before and the rest, starting with the stop char.
+// If `quoted` is set, stop characters inside of double quotes are ignored.
+func scanLine(s, stops string, quoted bool) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+		case quoted && c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && strings.IndexByte(stops, c) >= 0:
+			return s[:i], s[i:]
+		}
+	}
+	return s, ""
+}
+
+// splitPair splits `key=value` at the first unescaped `=`.
+func splitPair(pair string) (string, string, error) {
+	key, rest := scanLine(pair, "=", false)
+	if key == "" || rest == "" {
+		return "", "", fmt.Errorf("invalid key/value pair %q", pair)
+	}
+	return key, rest[1:], nil
+}
+
+var nameUnescaper = strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=")
+
+func unescapeName(s string) string {
+	return nameUnescaper.Replace(s)
+}
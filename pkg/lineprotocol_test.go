@@ -0,0 +1,150 @@
+package mqttinflux
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	payload := `
+# comment
+weather,location=us-midwest,season=summer temperature=82,humidity=71i 1465839830100400200
+cpu,host=a value=0.64,ok=t,name="foo, \"bar\" baz",count=3u
+`
+	measurements, err := parseLineProtocol(payload, "ns")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+
+	m := measurements[0]
+	if m.Name != "weather" {
+		t.Errorf("Unexpected name %q", m.Name)
+	}
+	if m.Tags["location"] != "us-midwest" || m.Tags["season"] != "summer" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	if m.Values["temperature"] != 82.0 || m.Values["humidity"] != int64(71) {
+		t.Errorf("Unexpected values %v", m.Values)
+	}
+	if m.Timestamp.UnixNano() != 1465839830100400200 {
+		t.Errorf("Unexpected timestamp %v", m.Timestamp.UnixNano())
+	}
+
+	m = measurements[1]
+	if m.Name != "cpu" {
+		t.Errorf("Unexpected name %q", m.Name)
+	}
+	if m.Tags["host"] != "a" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	if m.Values["name"] != `foo, "bar" baz` || m.Values["count"] != uint64(3) {
+		t.Errorf("Unexpected values %v", m.Values)
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	invalid := []string{
+		"weather",
+		"weather ",
+		",tag=a value=1",
+		"weather,tag value=1",
+		"weather value=abc",
+		"weather value=-1u",
+		"weather value=1 tomorrow",
+		"weather value=\"unterminated",
+		"m&m value=1",
+		// valid line protocol, but not supported by Measurement
+		"cpu\\ load value=1",
+		"cpu,host=a\\ value=1",
+	}
+
+	for _, line := range invalid {
+		_, err := parseLineProtocol(line, "ns")
+		if err == nil {
+			t.Errorf("Expected error for %q, got OK", line)
+		}
+	}
+}
+
+func TestParseLineProtocolTags(t *testing.T) {
+	payload := `disk,path=/,device=sda1 free=1000i
+disk,path=/mnt/my\ disk,label=a\,b\=c free=2000i`
+	measurements, err := parseLineProtocol(payload, "ns")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+
+	m := measurements[0]
+	if m.Tags["path"] != "/" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	expected := "disk,device=sda1,path=/ free=1000i"
+	if line := formatLine(&m); !strings.HasPrefix(line, expected+" ") {
+		t.Errorf("Expected %v, got %v", expected, line)
+	}
+
+	m = measurements[1]
+	if m.Tags["path"] != "/mnt/my disk" || m.Tags["label"] != "a,b=c" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	expected = `disk,label=a\,b\=c,path=/mnt/my\ disk free=2000i`
+	if line := formatLine(&m); !strings.HasPrefix(line, expected+" ") {
+		t.Errorf("Expected %v, got %v", expected, line)
+	}
+}
+
+func TestParseLineProtocolSkipsInvalidLines(t *testing.T) {
+	payload := "cpu usage=5\nmem used=abc\ndisk free=1000i"
+	measurements, err := parseLineProtocol(payload, "ns")
+	if err == nil {
+		t.Error("Expected error for invalid line, got OK")
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+	if measurements[0].Name != "cpu" || measurements[1].Name != "disk" {
+		t.Errorf("Unexpected measurements %v", measurements)
+	}
+}
+
+func TestLineProtocolSubscription(t *testing.T) {
+	s := &Subscription{
+		Mode:               "lineprotocol",
+		Database:           "edge",
+		TimestampPrecision: "s",
+		Tags: map[string]string{
+			"host": "{{.Topic 1}}",
+		},
+	}
+
+	measurements, err := s.ReadAll("telegraf/box1", "cpu,host=other usage=5 1600000000\nmem used=10i")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+	for _, m := range measurements {
+		if m.Tags["host"] != "box1" {
+			t.Errorf("Expected tag from topic, got %v", m.Tags)
+		}
+		if m.Database != "edge" {
+			t.Errorf("Expected database %q, got %q", "edge", m.Database)
+		}
+	}
+	if measurements[0].Timestamp.Unix() != 1600000000 {
+		t.Errorf("Unexpected timestamp %v", measurements[0].Timestamp)
+	}
+
+	s = &Subscription{Mode: "unknown"}
+	_, err = s.ReadAll("foo", "cpu usage=5")
+	if err == nil {
+		t.Error("Expected error for unknown mode, got OK")
+	}
+}
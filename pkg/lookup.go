@@ -0,0 +1,134 @@
+package mqttinflux
+
+// Lookup tables translate values before they are converted,
+// e.g. state enums to numbers or numeric ranges to a label.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a numeric range in a lookup key, e.g. "0-20", "20..", "..0" or "-10--5"
+var lookupRangePattern = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+))?\s*(?:\.\.|-)\s*([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+))?$`)
+
+// lookupRange is a range of numbers from `lower` (inclusive)
+// to `upper` (exclusive), nil bounds are open.
+type lookupRange struct {
+	key          string
+	lower, upper *float64
+}
+
+func (r lookupRange) contains(x float64) bool {
+	return (r.lower == nil || x >= *r.lower) && (r.upper == nil || x < *r.upper)
+}
+
+// parseLookupRange reads a range from a lookup key.
+// The second return value is false if the key is not a range.
+func parseLookupRange(key string) (lookupRange, bool) {
+	key = strings.TrimSpace(key)
+	// plain numbers like "-5" are values, not ranges
+	if _, err := strconv.ParseFloat(key, 64); err == nil {
+		return lookupRange{}, false
+	}
+	groups := lookupRangePattern.FindStringSubmatch(key)
+	if groups == nil || (groups[1] == "" && groups[2] == "") {
+		return lookupRange{}, false
+	}
+
+	r := lookupRange{key: key}
+	if groups[1] != "" {
+		lower, _ := strconv.ParseFloat(groups[1], 64)
+		r.lower = &lower
+	}
+	if groups[2] != "" {
+		upper, _ := strconv.ParseFloat(groups[2], 64)
+		r.upper = &upper
+	}
+	return r, true
+}
+
+// lookupRanges returns the ranges from the lookup keys,
+// sorted by their lower bound.
+func (c *Conversion) lookupRanges() []lookupRange {
+	var ranges []lookupRange
+	for key := range c.Lookup {
+		if r, ok := parseLookupRange(key); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		a, b := ranges[i].lower, ranges[j].lower
+		return a == nil && b != nil || a != nil && b != nil && *a < *b
+	})
+	return ranges
+}
+
+// translate applies the Lookup map to the value.
+// Exact matches take precedence over case-insensitive matches and ranges.
+func (c *Conversion) translate(raw string) (string, error) {
+	key := strings.TrimSpace(raw)
+	if translated, found := c.Lookup[key]; found {
+		return translated, nil
+	}
+
+	if c.IgnoreCase {
+		for k, translated := range c.Lookup {
+			if strings.EqualFold(strings.TrimSpace(k), key) {
+				return translated, nil
+			}
+		}
+	}
+
+	if x, err := strconv.ParseFloat(key, 64); err == nil {
+		for _, r := range c.lookupRanges() {
+			if r.contains(x) {
+				return c.Lookup[r.key], nil
+			}
+		}
+	}
+
+	if c.Default != nil {
+		return *c.Default, nil
+	}
+	if c.PassThrough {
+		return raw, nil
+	}
+	return "", fmt.Errorf("lookup failed for %q", key)
+}
+
+// validateLookup checks the lookup options for conflicts,
+// i.e. overlapping ranges or keys which only differ in case.
+func validateLookup(c *Conversion) error {
+	if c.Default != nil && c.PassThrough {
+		return errors.New("lookup default and passThrough are exclusive")
+	}
+
+	if c.IgnoreCase {
+		seen := make(map[string]string)
+		for key := range c.Lookup {
+			folded := strings.ToLower(strings.TrimSpace(key))
+			if other, ok := seen[folded]; ok {
+				return fmt.Errorf("lookup keys %q and %q differ only in case", other, key)
+			}
+			seen[folded] = key
+		}
+	}
+
+	ranges := c.lookupRanges()
+	for i, r := range ranges {
+		if r.lower != nil && r.upper != nil && *r.lower >= *r.upper {
+			return fmt.Errorf("empty lookup range %q", r.key)
+		}
+		if i > 0 {
+			prev := ranges[i-1]
+			if prev.upper == nil || r.lower == nil || *prev.upper > *r.lower {
+				return fmt.Errorf("lookup ranges %q and %q overlap", prev.key, r.key)
+			}
+		}
+	}
+	return nil
+}
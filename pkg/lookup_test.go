@@ -0,0 +1,66 @@
+package mqttinflux
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	c := Conversion{Kind: "integer", Lookup: map[string]string{"off": "0", "on": "1"}}
+	checkConversion(c, map[string]interface{}{"on": int64(1), " off ": int64(0)}, t)
+	checkExpectedErrors(c, []string{"ON", "standby"}, t)
+
+	c.IgnoreCase = true
+	checkConversion(c, map[string]interface{}{"ON": int64(1), "Off": int64(0)}, t)
+	checkExpectedErrors(c, []string{"standby"}, t)
+
+	fallback := "-1"
+	c.Default = &fallback
+	checkConversion(c, map[string]interface{}{"standby": int64(-1), "on": int64(1)}, t)
+
+	c = Conversion{Kind: "string", Lookup: map[string]string{"heat": "heating"}, PassThrough: true}
+	checkConversion(c, map[string]interface{}{"heat": "heating", "cool": "cool"}, t)
+}
+
+func TestLookupRanges(t *testing.T) {
+	var c Conversion
+	err := json.Unmarshal([]byte(`{
+		"kind": "string",
+		"lookup": {"..0": "frost", "0-20": "low", "20 - 30": "medium", "30..": "high", "-5": "exact"}
+	}`), &c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkConversion(c, map[string]interface{}{
+		"-12":  "frost",
+		"-5":   "exact",
+		"0":    "low",
+		"19.9": "low",
+		"20":   "medium",
+		"30":   "high",
+		"1e3":  "high",
+	}, t)
+	checkExpectedErrors(c, []string{"warm", ""}, t)
+
+	c = Conversion{Lookup: map[string]string{"-10--5": "a", "-5-0": "b"}}
+	checkConversion(c, map[string]interface{}{"-7": "a", "-5": "b", "-0.5": "b"}, t)
+	checkExpectedErrors(c, []string{"0", "-10.5"}, t)
+
+	empty := ""
+	invalid := []Conversion{
+		{Lookup: map[string]string{"0-20": "low", "10-30": "medium"}},
+		{Lookup: map[string]string{"0..": "low", "10-30": "medium"}},
+		{Lookup: map[string]string{"..10": "low", "..20": "medium"}},
+		{Lookup: map[string]string{"20-10": "low"}},
+		{Lookup: map[string]string{"on": "1", "ON": "1"}, IgnoreCase: true},
+		{Lookup: map[string]string{"on": "1"}, Default: &empty, PassThrough: true},
+	}
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", c)
+		}
+	}
+}
@@ -3,10 +3,11 @@ package mqttinflux
 import (
 	"bytes"
 	"encoding/csv"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"sort"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -15,65 +16,241 @@ import (
 )
 
 // Config settings.
+//
+// Credentials can be read from a file (e.g. a Docker secret) with the
+// `*File` variants. Every key can also be overridden from the environment,
+// see `applyOverrides`.
+//
+// With `Homie`, devices which follow the Homie convention are discovered
+// automatically. With `HomeAssistant`, subscriptions are created from
+// Home Assistant MQTT discovery messages.
 type Config struct {
-	PidFile    string `json:"pidfile"`
-	MQTTHost   string `json:"MQTTHost"`
-	MQTTPort   int    `json:"MQTTPort"`
-	MQTTUser   string `json:"MQTTUser"`
-	MQTTPass   string `json:"MQTTPass"`
-	InfluxHost string `json:"influxHost"`
-	InfluxPort int    `json:"influxPort"`
-	InfluxUser string `json:"influxUser"`
-	InfluxPass string `json:"influxPass"`
-	InfluxDB   string `json:"influxDB"`
+	PidFile             string `json:"pidfile"`
+	MQTTHost            string `json:"MQTTHost"`
+	MQTTPort            int    `json:"MQTTPort"`
+	MQTTUser            string `json:"MQTTUser"`
+	MQTTUserFile        string `json:"MQTTUserFile"`
+	MQTTPass            string `json:"MQTTPass"`
+	MQTTPassFile        string `json:"MQTTPassFile"`
+	InfluxHost          string `json:"influxHost"`
+	InfluxPort          int    `json:"influxPort"`
+	InfluxUser          string `json:"influxUser"`
+	InfluxUserFile      string `json:"influxUserFile"`
+	InfluxPass          string `json:"influxPass"`
+	InfluxPassFile      string `json:"influxPassFile"`
+	InfluxDB            string `json:"influxDB"`
+	Homie               bool   `json:"homie"`
+	HomieBaseTopic      string `json:"homieBaseTopic"`
+	HomeAssistant       bool   `json:"homeAssistant"`
+	HomeAssistantPrefix string `json:"homeAssistantPrefix"`
 }
 
 // Subscription describes a single subscription to an MQTT topic.
 // the topic can contain wildcards.
 //
 // Topic: The MQTT topic to subscribe to
+// Mode: optional, how to handle messages; by default, a measurement is
+//     created from templates. Use "lineprotocol" for line protocol payload,
+//     "sparkplug" for Sparkplug B and "homie" for Homie devices.
 // Measurement: The InfluxDB measurement to wubmit to
 // Database (optional): the name of the InfluxDB database. By default, the DB
 //     from `Config` is used.
+// TopicRegex: optional, a regular expression for the topic, named groups
+//     are available in templates with `{{.Match "name"}}`
 // Value: optional, specify a template for the value
+// Fields: optional, additional fields with their own value and conversion
+// Flatten: optional, write each value in a JSON payload to its own field
+// Timestamp: optional, a template for the time of the measurement
+// TimestampPrecision: optional, unit for numeric timestamps (s, ms, us, ns)
+// Foreach: optional, a JSON path to an array or object; one measurement is
+//     created for each element
+// PayloadFormat: optional, json (default), msgpack or cbor
+// CSVHeader: optional, the first line of a CSV payload contains column names
+// CSVRows: optional, create one measurement for each line of a CSV payload
+// When: optional, a condition which must hold for a message to be written
+// Preset: optional, read the payload of "zigbee2mqtt" or "tasmota" devices
+// Filter: optional, drop or clamp invalid numeric values
+// OnChangeOnly: optional, write a measurement only if its values changed
+// Deadband: optional, minimum change for numeric values (absolute or "2%")
+// MaxInterval: optional, write unchanged values after this duration
 // Conversion: how to convert values from MQTT to InfluxDB.
 type Subscription struct {
-	Topic           string            `json:"topic"`
-	Measurement     string            `json:"measurement"`
-	Database        string            `json:"database"`
-	Tags            map[string]string `json:"tags"`
-	Value           string            `json:"value"`
-	CSVSeparator    string            `json:"csvSeparator"`
-	Conversion      Conversion        `json:"conversion"`
-	cachedTemplates map[string]*template.Template
+	Topic              string            `json:"topic"`
+	Mode               string            `json:"mode"`
+	TopicRegex         string            `json:"topicRegex"`
+	Measurement        string            `json:"measurement"`
+	Database           string            `json:"database"`
+	Tags               map[string]string `json:"tags"`
+	Value              string            `json:"value"`
+	Fields             map[string]Field  `json:"fields"`
+	Flatten            *Flatten          `json:"flatten"`
+	Timestamp          string            `json:"timestamp"`
+	TimestampPrecision string            `json:"timestampPrecision"`
+	Foreach            string            `json:"foreach"`
+	When               string            `json:"when"`
+	Preset             string            `json:"preset"`
+	Filter             *Filter           `json:"filter"`
+	OnChangeOnly       bool              `json:"onChangeOnly"`
+	Deadband           Deadband          `json:"deadband"`
+	MaxInterval        string            `json:"maxInterval"`
+	PayloadFormat      string            `json:"payloadFormat"`
+	CSVSeparator       string            `json:"csvSeparator"`
+	CSVHeader          bool              `json:"csvHeader"`
+	CSVRows            bool              `json:"csvRows"`
+	CSVComment         string            `json:"csvComment"`
+	CSVLazyQuotes      bool              `json:"csvLazyQuotes"`
+	CSVTrimSpace       bool              `json:"csvTrimSpace"`
+	Conversion         Conversion        `json:"conversion"`
+	cachedTemplates    map[string]*template.Template
+	condition          exprNode
+	topicPattern       *regexp.Regexp
+	sparkplug          *sparkplugState
+	homie              *homieState
+	filters            *filterState
+	changes            *changeState
+	counters           *counterState
+	maxInterval        time.Duration
+}
+
+// Field describes an additional field for a measurement.
+//
+// Value: a template for the value, like `Subscription.Value`
+// Conversion: how to convert the value.
+// Filter: optional, replaces the filter of the subscription for this field
+type Field struct {
+	Value      string     `json:"value"`
+	Conversion Conversion `json:"conversion"`
+	Filter     *Filter    `json:"filter"`
 }
 
+// parseTemplates validates the subscription and prepares its templates,
+// condition and topic pattern. Nothing is cached unless every check passes,
+// so an invalid subscription fails on every call.
 func (s *Subscription) parseTemplates() error {
 	if s.cachedTemplates != nil {
 		return nil
 	}
 
-	// measurement + value + tags
-	count := 1 + 1 + len(s.Tags)
+	switch s.Mode {
+	case "", modeLineProtocol, modeSparkplug, modeHomie:
+	default:
+		return fmt.Errorf("unsupported mode %q", s.Mode)
+	}
+
+	if s.Preset != "" {
+		if _, ok := presets[s.Preset]; !ok {
+			return fmt.Errorf("unsupported preset %q", s.Preset)
+		}
+		if s.Mode != "" {
+			return fmt.Errorf("preset %q cannot be used with mode %q", s.Preset, s.Mode)
+		}
+	}
+
+	if s.Flatten != nil {
+		err := s.Flatten.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Filter != nil {
+		err := s.Filter.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	maxInterval, err := s.validateChangeOnly()
+	if err != nil {
+		return err
+	}
+
+	switch s.PayloadFormat {
+	case "", formatJSON, formatMsgpack, formatCBOR:
+	default:
+		return fmt.Errorf("unsupported payload format %q", s.PayloadFormat)
+	}
+
+	err = s.Conversion.validate()
+	if err != nil {
+		return err
+	}
+
+	// measurement + value + timestamp + tags + fields
+	count := 1 + 1 + 1 + len(s.Tags) + len(s.Fields)
 	raw := make(map[string]string, count)
-	s.cachedTemplates = make(map[string]*template.Template, count)
 
 	raw["measurement"] = s.Measurement
 	raw["value"] = "{{." + s.Value + "}}"
+	raw["timestamp"] = "{{." + s.Timestamp + "}}"
 
 	for k, v := range s.Tags {
 		raw["tag."+k] = v
 	}
 
+	for k, f := range s.Fields {
+		if f.Value == "" {
+			return fmt.Errorf("missing value for field %q", k)
+		}
+		err := f.Conversion.validate()
+		if err != nil {
+			return fmt.Errorf("field %q: %v", k, err)
+		}
+		if f.Filter != nil {
+			err = f.Filter.validate()
+			if err != nil {
+				return fmt.Errorf("field %q: %v", k, err)
+			}
+		}
+		raw["field."+k] = "{{." + f.Value + "}}"
+	}
+
+	templates := make(map[string]*template.Template, count)
 	for name, text := range raw {
 		t := template.New(name)
 		_, err := t.Parse(text)
 		if err != nil {
 			return err
 		}
-		s.cachedTemplates[name] = t
+		templates[name] = t
+	}
+
+	var topicPattern *regexp.Regexp
+	if s.TopicRegex != "" {
+		topicPattern, err = regexp.Compile(s.TopicRegex)
+		if err != nil {
+			return fmt.Errorf("invalid topicRegex %q: %v", s.TopicRegex, err)
+		}
+	}
+
+	var condition exprNode
+	if s.When != "" {
+		condition, err = parseExpr(s.When)
+		if err != nil {
+			return fmt.Errorf("invalid condition %q: %v", s.When, err)
+		}
 	}
 
+	// all checks passed
+	switch s.Mode {
+	case modeSparkplug:
+		s.sparkplug = newSparkplugState()
+	case modeHomie:
+		s.homie = newHomieState()
+	}
+	if s.hasFilters() {
+		s.filters = newFilterState()
+	}
+	if s.changeOnly() {
+		s.changes = newChangeState()
+	}
+	if s.hasCounters() {
+		s.counters = newCounterState()
+	}
+	s.maxInterval = maxInterval
+	s.topicPattern = topicPattern
+	s.condition = condition
+	s.cachedTemplates = templates
 	return nil
 }
 
@@ -86,6 +263,115 @@ func (s *Subscription) Read(topic, payload string) (Measurement, error) {
 	}
 
 	ctx := NewTemplateContext(s, topic, payload)
+	return s.read(ctx)
+}
+
+// ReadAll reads all Measurements from the given MQTT topic and payload.
+//
+// Without `Foreach` or `CSVRows`, this is the same as `Read`. Otherwise,
+// one Measurement is created for each element that is selected with
+// `Foreach` or for each row in a CSV payload.
+// In "lineprotocol" mode, one Measurement is read from each line,
+// in "sparkplug" mode, one Measurement is created for each metric
+// and in "homie" mode, one Measurement is created for a property value.
+// With a `Preset`, one Measurement with multiple fields is created.
+// Elements which cannot be read are skipped and the first error is returned
+// along with the Measurements that were read successfully.
+// Finally, counters are replaced with their rate or delta, the `Filter`
+// is applied to the Measurements and unchanged Measurements are skipped
+// if `OnChangeOnly` or a `Deadband` is set.
+func (s *Subscription) ReadAll(topic, payload string) ([]Measurement, error) {
+	measurements, err := s.readAll(topic, payload)
+	measurements, counterErr := s.applyCounters(measurements)
+	if err == nil {
+		err = counterErr
+	}
+	return s.skipUnchanged(s.applyFilters(measurements)), err
+}
+
+func (s *Subscription) readAll(topic, payload string) ([]Measurement, error) {
+	err := s.parseTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := NewTemplateContext(s, topic, payload)
+	switch s.Mode {
+	case modeLineProtocol:
+		return s.readLineProtocol(ctx)
+	case modeSparkplug:
+		return s.readSparkplug(ctx)
+	case modeHomie:
+		return s.readHomie(ctx)
+	}
+	if s.Preset != "" {
+		return s.readPreset(ctx)
+	}
+
+	var items []foreachItem
+	if s.Foreach != "" {
+		items, err = ctx.foreachItems(s.Foreach)
+	} else if s.CSVRows {
+		items, err = ctx.csvItems()
+	} else {
+		m, err := s.read(ctx)
+		if err == ErrSkipped {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return []Measurement{m}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	measurements := make([]Measurement, 0, len(items))
+	for _, item := range items {
+		itemCtx := ctx
+		itemCtx.item = &item
+		m, err := s.read(itemCtx)
+		if err == ErrSkipped {
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("element %q: %v", item.key, err)
+			}
+			continue
+		}
+		measurements = append(measurements, m)
+	}
+
+	return measurements, firstErr
+}
+
+// matches tells if the `When` condition holds for the given context.
+// Subscriptions without a condition match every message.
+func (s *Subscription) matches(ctx TemplateContext) bool {
+	return s.condition == nil || evalCondition(s.condition, &ctx)
+}
+
+// fillTags returns the values of the `Tags` for the given context.
+func (s *Subscription) fillTags(ctx TemplateContext) (map[string]string, error) {
+	tags := make(map[string]string, len(s.Tags))
+	for tag := range s.Tags {
+		tagValue, err := s.fillTemplate("tag."+tag, ctx)
+		if err != nil {
+			return nil, err
+		}
+		tags[tag] = tagValue
+	}
+	return tags, nil
+}
+
+// read a Measurement for the given context.
+func (s *Subscription) read(ctx TemplateContext) (Measurement, error) {
+	var m Measurement
+	if !s.matches(ctx) {
+		return m, ErrSkipped
+	}
+
 	measurementName, err := s.fillTemplate("measurement", ctx)
 	if err != nil {
 		return m, err
@@ -93,33 +379,110 @@ func (s *Subscription) Read(topic, payload string) (Measurement, error) {
 	m = NewMeasurement(s.Database, measurementName)
 
 	// value from payload, optional template
-	var rawValue string
-	if s.Value == "" {
-		rawValue = payload
-	} else {
-		rawValue, err = s.fillTemplate("value", ctx)
+	// with additional fields, the value is optional
+	if s.Value != "" || (len(s.Fields) == 0 && s.Flatten == nil) {
+		var rawValue string
+		if s.Value != "" {
+			rawValue, err = s.fillTemplate("value", ctx)
+		} else if ctx.item != nil && ctx.item.record == nil {
+			rawValue, err = ctx.Item("")
+		} else {
+			rawValue = ctx.Payload
+		}
+		if err != nil {
+			return m, err
+		}
+
+		converted, err := s.Conversion.withContext(ctx).Convert(rawValue)
+		if err != nil {
+			return m, err
+		}
+		m.SetValue(converted)
+		s.Conversion.addTags(&m)
+	}
+
+	for name, field := range s.Fields {
+		rawValue, err := s.fillTemplate("field."+name, ctx)
+		if err != nil {
+			return m, fmt.Errorf("field %q: %v", name, err)
+		}
+		converted, err := field.Conversion.withContext(ctx).Convert(rawValue)
+		if err != nil {
+			return m, fmt.Errorf("field %q: %v", name, err)
+		}
+		m.SetField(name, converted)
+		field.Conversion.addTags(&m)
+	}
+
+	if s.Flatten != nil {
+		data, err := ctx.flattenData(s.Flatten.Path)
 		if err != nil {
 			return m, err
 		}
+		s.Flatten.flattenFields(&m, data)
 	}
 
-	converted, err := s.Conversion.Convert(rawValue)
+	tags, err := s.fillTags(ctx)
 	if err != nil {
 		return m, err
 	}
-	m.SetValue(converted)
+	for tag, tagValue := range tags {
+		m.Tag(tag, tagValue)
+	}
 
-	for tag := range s.Tags {
-		tagValue, err := s.fillTemplate("tag."+tag, ctx)
+	if s.Timestamp != "" {
+		rawTimestamp, err := s.fillTemplate("timestamp", ctx)
+		if err != nil {
+			return m, err
+		}
+		m.Timestamp, err = parseTimestamp(rawTimestamp, s.TimestampPrecision)
 		if err != nil {
 			return m, err
 		}
-		m.Tag(tag, tagValue)
 	}
 
 	return m, nil
 }
 
+// parseTimestamp reads a point in time from either a number (unix time with
+// the given precision) or an RFC 3339 string.
+func parseTimestamp(raw, precision string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	number, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return time.Parse(time.RFC3339Nano, raw)
+	}
+
+	var unit time.Duration
+	switch precision {
+	case "", "s":
+		unit = time.Second
+	case "ms":
+		unit = time.Millisecond
+	case "us":
+		unit = time.Microsecond
+	case "ns":
+		unit = time.Nanosecond
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp precision %q", precision)
+	}
+
+	// avoid float rounding errors for integer values
+	if integer, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		if integer > math.MaxInt64/int64(unit) || integer < math.MinInt64/int64(unit) {
+			return time.Time{}, fmt.Errorf("timestamp out of range: %v", raw)
+		}
+		return time.Unix(0, integer*int64(unit)), nil
+	}
+
+	nanos := number * float64(unit)
+	// float64(math.MaxInt64) rounds up to 2^63, which is out of range
+	if math.IsNaN(nanos) || nanos >= math.MaxInt64 || nanos < math.MinInt64 {
+		return time.Time{}, fmt.Errorf("timestamp out of range: %v", raw)
+	}
+	return time.Unix(0, int64(nanos)), nil
+}
+
 func (s *Subscription) fillTemplate(name string, ctx TemplateContext) (string, error) {
 	t, ok := s.cachedTemplates[name]
 	if !ok {
@@ -142,6 +505,35 @@ type TemplateContext struct {
 	Payload      string
 	Parts        []string
 	subscription *Subscription
+	decoded      *decodedPayload
+	item         *foreachItem
+	value        *string // the raw value in an expression conversion
+}
+
+// foreachItem is a single element selected with `Subscription.Foreach`
+// or a single row from a CSV payload with `Subscription.CSVRows`.
+type foreachItem struct {
+	key    string
+	value  interface{}
+	record []string
+}
+
+// decodedPayload holds the payload once it has been decoded.
+// It is shared between copies of a TemplateContext, so that the payload is
+// decoded at most once per message.
+type decodedPayload struct {
+	done    bool
+	data    interface{}
+	err     error
+	csvDone bool
+	csv     *csvDocument
+	csvErr  error
+}
+
+// csvDocument is a CSV payload with its (optional) header.
+type csvDocument struct {
+	header  map[string]int
+	records [][]string
 }
 
 // NewTemplateContext creates a new TemplateContext from an MQTT message.
@@ -151,6 +543,7 @@ func NewTemplateContext(subscription *Subscription, topic, payload string) Templ
 		Payload:      payload,
 		Parts:        strings.Split(topic, "/"),
 		subscription: subscription,
+		decoded:      new(decodedPayload),
 	}
 }
 
@@ -163,65 +556,357 @@ func (ctx *TemplateContext) Topic(index int) (string, error) {
 	return ctx.Parts[index], nil
 }
 
+// Match returns the value of a capture group from the subscription's
+// `topicRegex`. The group is selected by name or by its number.
+func (ctx *TemplateContext) Match(group string) (string, error) {
+	pattern := ctx.subscription.topicPattern
+	if pattern == nil {
+		return "", errors.New("no topicRegex for subscription")
+	}
+
+	groups := pattern.FindStringSubmatch(ctx.FullTopic)
+	if groups == nil {
+		return "", fmt.Errorf("topic %q does not match %q", ctx.FullTopic,
+			pattern.String())
+	}
+
+	index := pattern.SubexpIndex(group)
+	if index < 0 {
+		n, err := strconv.Atoi(group)
+		if err != nil || n < 0 || n >= len(groups) {
+			return "", fmt.Errorf("no group %q in topicRegex", group)
+		}
+		index = n
+	}
+
+	return groups[index], nil
+}
+
 // JSON parses payload as JSON using jsonq
 // and gets a value from the resulting data structure
 //
 // `path` is a dotted path to access nested maps.
 // e.g. `foo.bar.baz` would return `data['foo']['bar']['baz']`.
+// Use a backslash to escape dots in names, e.g. `foo\.bar`.
+//
+// If `path` starts with `$`, it is evaluated as a JSONPath expression
+// and the first matching value is returned.
 func (ctx *TemplateContext) JSON(path string) (string, error) {
-	data := make(map[string]interface{})
-	dec := json.NewDecoder(strings.NewReader(ctx.Payload))
-	err := dec.Decode(&data)
+	value, err := ctx.lookupJSON(path)
 	if err != nil {
 		return "", err
 	}
 
-	parts := strings.Split(path, ".")
+	// converts int, float, bool, etc to string
+	return formatDecoded(value), nil
+}
 
-	query := jsonq.NewQuery(data)
-	value, err := query.Interface(parts...)
+// Item returns a value from the current element when a subscription
+// iterates over an array or object with `foreach`.
+//
+// `path` is relative to the element and uses the same syntax as `JSON`.
+// An empty path returns the element itself.
+func (ctx *TemplateContext) Item(path string) (string, error) {
+	if ctx.item == nil {
+		return "", errors.New("no foreach element")
+	}
+
+	value := ctx.item.value
+	if path != "" {
+		var err error
+		value, err = lookupPath(value, path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return formatDecoded(value), nil
+}
+
+// Key returns the index or the key of the current element
+// when a subscription iterates over an array or object with `foreach`.
+func (ctx *TemplateContext) Key() (string, error) {
+	if ctx.item == nil {
+		return "", errors.New("no foreach element")
+	}
+	return ctx.item.key, nil
+}
+
+// foreachItems selects the elements at `path` from the decoded payload.
+// If the path refers to a single array or object, its children are used.
+func (ctx *TemplateContext) foreachItems(path string) ([]foreachItem, error) {
+	data, err := ctx.document()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// converts int, float, bool, etc to string
-	return fmt.Sprintf("%v", value), nil
+	// a JSONPath can select any number of elements,
+	// a dotted path must point to an array or object
+	var values []interface{}
+	if isJSONPath(path) {
+		values, err = queryJSONPath(data, path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		value, err := jsonq.NewQuery(data).Interface(splitPath(path)...)
+		if err != nil {
+			return nil, err
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			return nil, fmt.Errorf("%q is not an array or object", path)
+		}
+		values = []interface{}{value}
+	}
+
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case map[string]interface{}:
+			keys := sortedKeys(v)
+			items := make([]foreachItem, len(keys))
+			for i, key := range keys {
+				items[i] = foreachItem{key: key, value: v[key]}
+			}
+			return items, nil
+		case []interface{}:
+			values = v
+		}
+	}
+
+	items := make([]foreachItem, len(values))
+	for i, value := range values {
+		items[i] = foreachItem{key: strconv.Itoa(i), value: value}
+	}
+	return items, nil
+}
+
+// lookupJSON returns the value at `path` from the decoded payload.
+func (ctx *TemplateContext) lookupJSON(path string) (interface{}, error) {
+	data, err := ctx.document()
+	if err != nil {
+		return nil, err
+	}
+	return lookupPath(data, path)
+}
+
+// lookupPath returns the value at `path` (dotted or JSONPath) from `data`.
+func lookupPath(data interface{}, path string) (interface{}, error) {
+	if isJSONPath(path) {
+		values, err := queryJSONPath(data, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no value for %q", path)
+		}
+		return values[0], nil
+	}
+
+	query := jsonq.NewQuery(data)
+	return query.Interface(splitPath(path)...)
+}
+
+// document returns the decoded payload (JSON, MessagePack or CBOR).
+// The payload is decoded on first access, subsequent calls use the result
+// from the first call.
+func (ctx *TemplateContext) document() (interface{}, error) {
+	if ctx.decoded == nil {
+		ctx.decoded = new(decodedPayload)
+	}
+	d := ctx.decoded
+	if !d.done {
+		d.data, d.err = decodePayload(ctx.subscription.PayloadFormat, ctx.Payload)
+		d.done = true
+	}
+	return d.data, d.err
+}
+
+// flattenData returns the data for `Flatten`, either the current
+// foreach element or the payload, optionally selected with a path.
+func (ctx *TemplateContext) flattenData(path string) (interface{}, error) {
+	var data interface{}
+	if ctx.item != nil && ctx.item.record == nil {
+		data = ctx.item.value
+	} else {
+		var err error
+		data, err = ctx.document()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if path == "" {
+		return data, nil
+	}
+	return lookupPath(data, path)
+}
+
+// splitPath splits a dotted path into its parts.
+// Dots preceded by a backslash are part of the name.
+func splitPath(path string) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '\\' && i+1 < len(path) && path[i+1] == '.' {
+			current.WriteByte('.')
+			i++
+		} else if c == '.' {
+			parts = append(parts, current.String())
+			current.Reset()
+		} else {
+			current.WriteByte(c)
+		}
+	}
+	return append(parts, current.String())
 }
 
-// CSV parses the payload as a CSV file and returns the value from `colIndex`
-func (ctx *TemplateContext) CSV(colIndex int) (string, error) {
-	payloadReader := strings.NewReader(ctx.Payload)
-	csvReader := csv.NewReader(payloadReader)
-	separator := ctx.subscription.CSVSeparator
+// CSV parses the payload as a CSV file and returns the value from `column`.
+//
+// The column is selected by its zero-based index or, if the subscription
+// has `csvHeader` set, by the name from the header.
+// The value is read from the current row if the subscription uses
+// `csvRows` and from the first record otherwise.
+func (ctx *TemplateContext) CSV(column interface{}) (string, error) {
+	var record []string
+	if ctx.item != nil && ctx.item.record != nil {
+		record = ctx.item.record
+	} else {
+		doc, err := ctx.csvDocument()
+		if err != nil {
+			return "", err
+		}
+		if len(doc.records) == 0 {
+			return "", errors.New("no CSV records in payload")
+		}
+		record = doc.records[0]
+	}
+
+	var colIndex int
+	switch c := column.(type) {
+	case int:
+		colIndex = c
+	case string:
+		doc, err := ctx.csvDocument()
+		if err != nil {
+			return "", err
+		}
+		index, found := doc.header[c]
+		if !found {
+			return "", fmt.Errorf("no CSV column named %q", c)
+		}
+		colIndex = index
+	default:
+		return "", fmt.Errorf("invalid CSV column %v", column)
+	}
+
+	maxIndex := len(record) - 1
+	if colIndex < 0 || colIndex > maxIndex {
+		return "", fmt.Errorf("column index %v is out of range (max: %v)",
+			colIndex, maxIndex)
+	}
+
+	return record[colIndex], nil
+}
+
+// csvDocument returns the payload parsed as CSV.
+// The payload is parsed on first access, subsequent calls use the result
+// from the first call.
+func (ctx *TemplateContext) csvDocument() (*csvDocument, error) {
+	if ctx.decoded == nil {
+		ctx.decoded = new(decodedPayload)
+	}
+	d := ctx.decoded
+	if !d.csvDone {
+		d.csv, d.csvErr = parseCSV(ctx.subscription, ctx.Payload)
+		d.csvDone = true
+	}
+	return d.csv, d.csvErr
+}
+
+func parseCSV(s *Subscription, payload string) (*csvDocument, error) {
+	csvReader := csv.NewReader(strings.NewReader(payload))
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = s.CSVLazyQuotes
+	csvReader.TrimLeadingSpace = s.CSVTrimSpace
+
+	separator := s.CSVSeparator
 	if separator != "" {
 		runes := []rune(separator)
 		if len(runes) != 1 {
-			return "", fmt.Errorf("Invalid CSV separator %q", separator)
+			return nil, fmt.Errorf("Invalid CSV separator %q", separator)
 		}
 		csvReader.Comma = runes[0]
 	}
 
-	records, err := csvReader.Read()
-	if err != nil {
-		return "", err
+	if s.CSVComment != "" {
+		runes := []rune(s.CSVComment)
+		if len(runes) != 1 {
+			return nil, fmt.Errorf("Invalid CSV comment character %q", s.CSVComment)
+		}
+		csvReader.Comment = runes[0]
 	}
 
-	maxIndex := len(records) - 1
-	if colIndex > maxIndex {
-		return "", fmt.Errorf("column index %v is out of range (max: %v)",
-			colIndex, maxIndex)
+	// only the first record is needed unless we read all rows
+	var records [][]string
+	if s.CSVRows || s.CSVHeader {
+		var err error
+		records, err = csvReader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		record, err := csvReader.Read()
+		if err != nil {
+			return nil, err
+		}
+		records = [][]string{record}
+	}
+
+	doc := &csvDocument{records: records}
+	if s.CSVHeader {
+		if len(records) == 0 {
+			return nil, errors.New("missing CSV header")
+		}
+		doc.header = make(map[string]int, len(records[0]))
+		for index, name := range records[0] {
+			doc.header[strings.TrimSpace(name)] = index
+		}
+		doc.records = records[1:]
 	}
 
-	return records[colIndex], nil
+	return doc, nil
+}
+
+// csvItems returns one item for each data row in a CSV payload.
+func (ctx *TemplateContext) csvItems() ([]foreachItem, error) {
+	doc, err := ctx.csvDocument()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]foreachItem, len(doc.records))
+	for i, record := range doc.records {
+		items[i] = foreachItem{key: strconv.Itoa(i), record: record}
+	}
+	return items, nil
 }
 
 // Measurement is a single measurement to be submitted to InfluxDB.
+//
+// Values holds the typed field values, which are one of
+// float64, int64, uint64, bool or string.
 type Measurement struct {
 	Database  string
 	Name      string
 	Timestamp time.Time
-	Values    map[string]string
+	Values    map[string]interface{}
 	Tags      map[string]string
+	// points from line protocol may use any tag keys and values,
+	// they are escaped when the point is written
+	escapedTags bool
 }
 
 // NewMeasurement creates a new measurement for the given `database`
@@ -231,7 +916,7 @@ func NewMeasurement(database, name string) Measurement {
 		Database:  database,
 		Name:      name,
 		Timestamp: time.Now(),
-		Values:    make(map[string]string, 0),
+		Values:    make(map[string]interface{}, 0),
 		Tags:      make(map[string]string, 0),
 	}
 	return m
@@ -243,48 +928,13 @@ func (m *Measurement) Tag(name, value string) {
 }
 
 // SetValue sets the value for this measurement.
-// The `value` is supplied in a string representation.
-func (m *Measurement) SetValue(value string) {
-	m.Values["value"] = value
+func (m *Measurement) SetValue(value interface{}) {
+	m.SetField("value", value)
 }
 
-// Format returns the "Line Protocol" representation for this measurement.
-// See: https://docs.influxdata.com/influxdb/v1.5/write_protocols/line_protocol_reference/
-func (m *Measurement) Format() string {
-	// pattern:
-	// <measurement>[,<tag_key>=<tag_value>[,<tag_key>=<tag_value>]] <field_key>=<field_value>[,<field_key>=<field_value>] [<timestamp>]
-
-	// <measurement>
-	s := m.Name
-
-	// sorted tags (for performance on recevier side)
-	var tagNames []string
-	for tagName := range m.Tags {
-		tagNames = append(tagNames, tagName)
-	}
-	sort.Strings(tagNames)
-
-	// ,<tag_key>=<tag_value>
-	for _, tagName := range tagNames {
-		tagValue := m.Tags[tagName]
-		s += fmt.Sprintf(",%v=%v", tagName, tagValue)
-	}
-
-	// <field_key>=<field_value>[,<field_key>=<field_value>]
-	s += " "
-	fieldCounter := 0
-	fieldSeparator := ""
-	for fieldName, fieldValue := range m.Values {
-		if fieldCounter > 0 {
-			fieldSeparator = ","
-		}
-		s += fmt.Sprintf("%v%v=%v", fieldSeparator, fieldName, fieldValue)
-		fieldCounter++
-	}
-
-	//[ <timestamp>]
-	s += fmt.Sprintf(" %d", m.Timestamp.UnixNano())
-	return s
+// SetField sets the value for the field with the given `name`.
+func (m *Measurement) SetField(name string, value interface{}) {
+	m.Values[name] = value
 }
 
 // Validate this measurement.
@@ -303,22 +953,32 @@ func (m *Measurement) Validate() error {
 		return errors.New("At least one value is required")
 	}
 
-	for fieldName := range m.Values {
+	for fieldName, value := range m.Values {
 		if !fieldPattern.MatchString(fieldName) {
 			return errors.New("Invalid field name")
 		}
 
-		//if !valuePattern.MatchString(value) {
-		//	return errors.New("Invalid value format")
-		//}
+		switch v := value.(type) {
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("Invalid value for field %q", fieldName)
+			}
+		case int64, uint64, bool, string:
+		default:
+			return fmt.Errorf("Invalid value type %T for field %q", value, fieldName)
+		}
 	}
 
+	namePattern, valuePattern := tagPattern, tagValuePattern
+	if m.escapedTags {
+		namePattern, valuePattern = escapedTagPattern, escapedTagPattern
+	}
 	for tagName, tagValue := range m.Tags {
-		if !tagPattern.MatchString(tagName) {
+		if !namePattern.MatchString(tagName) {
 			return errors.New("Invalid tag name")
 		}
 
-		if !tagValuePattern.MatchString(tagValue) {
+		if !valuePattern.MatchString(tagValue) {
 			return errors.New("Invalid tag value")
 		}
 	}
@@ -1,6 +1,7 @@
 package mqttinflux
 
 import (
+	"math"
 	"strings"
 	"testing"
 )
@@ -25,7 +26,7 @@ func TestMeasurementTag(t *testing.T) {
 	m := NewMeasurement("db", "m")
 	m.SetValue("1")
 	m.Tag("foo", "bar")
-	s := m.Format()
+	s := formatLine(&m)
 
 	if !strings.Contains(s, "foo=bar") {
 		t.Fail()
@@ -125,15 +126,17 @@ func TestTemplateJSON(t *testing.T) {
 	  "foo": {
 	    "bar": "value",
 		"intvalue": 123,
+		"floatvalue": 1.5e3,
 		"arr": [1, 2, 3]
 	  }
     }`
 	ctx := NewTemplateContext(s, "foo/bar/baz", jsonPayload)
 
 	cases := map[string]string{
-		"foo.bar":      "value",
-		"foo.intvalue": "123",
-		"foo.arr.1":    "2",
+		"foo.bar":        "value",
+		"foo.intvalue":   "123",
+		"foo.floatvalue": "1500",
+		"foo.arr.1":      "2",
 	}
 
 	for path, expected := range cases {
@@ -213,8 +216,8 @@ func TestHandleCSV(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
-	if m.Values["value"] != "456.0" {
-		t.Errorf("expected 456, got %v", err)
+	if m.Values["value"] != 456.0 {
+		t.Errorf("expected 456, got %v", m.Values["value"])
 	}
 }
 
@@ -230,8 +233,8 @@ func TestCSVCustomSeparator(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 
-	if m.Values["value"] != "456" {
-		t.Errorf("expected 456, got %v", err)
+	if m.Values["value"] != 456.0 {
+		t.Errorf("expected 456, got %v", m.Values["value"])
 	}
 
 	// invalid separator
@@ -241,3 +244,313 @@ func TestCSVCustomSeparator(t *testing.T) {
 		t.Error("Expected error, got ok")
 	}
 }
+
+func TestTemplateMatch(t *testing.T) {
+	s := &Subscription{
+		Topic:       "sensors/+",
+		TopicRegex:  `^sensors/(?P<room>[a-z]+)_(?P<kind>[a-z]+)_(\d+)$`,
+		Measurement: "{{.Match \"kind\"}}",
+		Tags: map[string]string{
+			"room":   "{{.Match \"room\"}}",
+			"sensor": "{{.Match \"3\"}}",
+		},
+	}
+
+	m, err := s.Read("sensors/kitchen_temp_01", "21.5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Name != "temp" {
+		t.Errorf("Expected measurement %q, got %q", "temp", m.Name)
+	}
+	if m.Tags["room"] != "kitchen" {
+		t.Errorf("Expected tag %q, got %q", "kitchen", m.Tags["room"])
+	}
+	if m.Tags["sensor"] != "01" {
+		t.Errorf("Expected tag %q, got %q", "01", m.Tags["sensor"])
+	}
+
+	// topic does not match
+	_, err = s.Read("sensors/kitchen", "21.5")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+
+	// unknown group
+	ctx := NewTemplateContext(s, "sensors/kitchen_temp_01", "")
+	_, err = ctx.Match("unknown")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+
+	// invalid pattern
+	s = &Subscription{TopicRegex: "(unclosed"}
+	err = s.parseTemplates()
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestTemplateJSONDecodedOnce(t *testing.T) {
+	ctx := NewTemplateContext(&Subscription{}, "foo/bar", `{"foo": 1}`)
+
+	// copies of the context share the decoded payload
+	other := ctx
+	_, err := other.JSON("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ctx.decoded.done {
+		t.Error("Expected decoded payload to be shared")
+	}
+
+	// replace the payload, the cached document is used
+	ctx.Payload = "not JSON"
+	value, err := ctx.JSON("foo")
+	if err != nil || value != "1" {
+		t.Errorf("Expected cached value, got %q (%v)", value, err)
+	}
+}
+
+func TestForeach(t *testing.T) {
+	s := &Subscription{
+		Topic:       "ble/+",
+		Measurement: "climate",
+		Foreach:     "readings",
+		Tags: map[string]string{
+			"mac":     "{{.Item \"mac\"}}",
+			"gateway": "{{.Topic 1}}",
+		},
+		Fields: map[string]Field{
+			"temperature": {
+				Value:      "Item \"t\"",
+				Conversion: Conversion{Kind: "float", Precision: 1},
+			},
+		},
+		Timestamp: "Item \"ts\"",
+		When:      "Item \"t\" != ''",
+	}
+
+	payload := `{"readings": [
+		{"mac": "aa:bb", "t": 21.5, "ts": 1600000000},
+		{"mac": "cc:dd", "t": 19, "ts": 1600000001},
+		{"mac": "ee:ff", "t": "", "ts": 1600000002}
+	]}`
+	measurements, err := s.ReadAll("ble/gw1", payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+
+	m := measurements[1]
+	if m.Tags["mac"] != "cc:dd" || m.Tags["gateway"] != "gw1" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	if m.Values["temperature"] != 19.0 {
+		t.Errorf("Expected 19.0, got %v", m.Values["temperature"])
+	}
+	if _, found := m.Values["value"]; found {
+		t.Error("Expected no default value with fields")
+	}
+	if m.Timestamp.Unix() != 1600000001 {
+		t.Errorf("Unexpected timestamp %v", m.Timestamp)
+	}
+}
+
+func TestForeachObject(t *testing.T) {
+	s := &Subscription{
+		Measurement: "{{.Key}}",
+		Foreach:     "$.sensors",
+		Conversion:  Conversion{Kind: "integer"},
+	}
+
+	measurements, err := s.ReadAll("foo", `{"sensors": {"b": 2, "a": 1}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+	if measurements[0].Name != "a" || measurements[0].Values["value"] != int64(1) {
+		t.Errorf("Unexpected measurement %v", measurements[0])
+	}
+
+	// one invalid element does not affect the others
+	measurements, err = s.ReadAll("foo", `{"sensors": {"b": "x", "a": 1}}`)
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+	if len(measurements) != 1 {
+		t.Errorf("Expected 1 measurement, got %v", len(measurements))
+	}
+
+	// not an array
+	s = &Subscription{Measurement: "m", Foreach: "sensors"}
+	_, err = s.ReadAll("foo", `{"sensors": 1}`)
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	cases := map[string]int64{
+		"1600000000":           1600000000000000000,
+		"1600000000.5":         1600000000500000000,
+		"2020-09-13T12:26:40Z": 1600000000000000000,
+	}
+	for raw, expected := range cases {
+		ts, err := parseTimestamp(raw, "")
+		if err != nil {
+			t.Errorf("Parsing %v: %v", raw, err)
+		} else if ts.UnixNano() != expected {
+			t.Errorf("Parsing %v: expected %v, got %v", raw, expected, ts.UnixNano())
+		}
+	}
+
+	ts, err := parseTimestamp("1600000000123", "ms")
+	if err != nil || ts.UnixNano() != 1600000000123000000 {
+		t.Errorf("Unexpected timestamp %v (%v)", ts, err)
+	}
+
+	_, err = parseTimestamp("123", "days")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+	_, err = parseTimestamp("yesterday", "")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+
+	// 2^63 ns is out of range
+	outOfRange := []string{"9223372037", "-9223372037", "9223372036.9", "1e30", "NaN", "-Inf"}
+	for _, raw := range outOfRange {
+		ts, err = parseTimestamp(raw, "s")
+		if err == nil {
+			t.Errorf("Parsing %v: expected error, got %v", raw, ts)
+		}
+	}
+	ts, err = parseTimestamp("9223372036", "s")
+	if err != nil || ts.UnixNano() != 9223372036000000000 {
+		t.Errorf("Unexpected timestamp %v (%v)", ts, err)
+	}
+	ts, err = parseTimestamp("9223372036854775807", "ns")
+	if err != nil || ts.UnixNano() != math.MaxInt64 {
+		t.Errorf("Unexpected timestamp %v (%v)", ts, err)
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	s := &Subscription{
+		Measurement: "test",
+		Value:       "CSV \"temperature\"",
+		CSVHeader:   true,
+	}
+
+	m, err := s.Read("foo/bar", "time,temperature\n123,21.5\n124,22.0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != 21.5 {
+		t.Errorf("expected 21.5, got %v", m.Values["value"])
+	}
+
+	s.Value = "CSV \"unknown\""
+	s.cachedTemplates = nil
+	_, err = s.Read("foo/bar", "time,temperature\n123,21.5")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestCSVRows(t *testing.T) {
+	s := &Subscription{
+		Measurement:   "climate",
+		CSVHeader:     true,
+		CSVRows:       true,
+		CSVSeparator:  ";",
+		CSVComment:    "#",
+		CSVTrimSpace:  true,
+		CSVLazyQuotes: true,
+		Tags: map[string]string{
+			"sensor": "{{.CSV \"sensor\"}}",
+		},
+		Fields: map[string]Field{
+			"temperature": {
+				Value:      "CSV \"temperature\"",
+				Conversion: Conversion{Kind: "float", Precision: 1},
+			},
+			"humidity": {
+				Value:      "CSV 3",
+				Conversion: Conversion{Kind: "integer"},
+			},
+			"label": {
+				Value:      "CSV \"label\"",
+				Conversion: Conversion{Kind: "string"},
+			},
+		},
+		Timestamp: "CSV 0",
+	}
+
+	payload := `time; sensor; temperature; humidity; label
+# a comment
+1600000000; "a"; 21.5; 40; ok
+1600000060; b; 22; 41; 5" pipe
+`
+	measurements, err := s.ReadAll("logger/1", payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+
+	for _, m := range measurements {
+		if err := m.Validate(); err != nil {
+			t.Errorf("Invalid measurement %v: %v", m, err)
+		}
+	}
+
+	m := measurements[1]
+	if m.Tags["sensor"] != "b" {
+		t.Errorf("Unexpected tag %q", m.Tags["sensor"])
+	}
+	if m.Values["temperature"] != 22.0 || m.Values["humidity"] != int64(41) {
+		t.Errorf("Unexpected values %v", m.Values)
+	}
+	// lazy quotes allow a quote in an unquoted field
+	if m.Values["label"] != "5\" pipe" {
+		t.Errorf("Unexpected label %q", m.Values["label"])
+	}
+	if m.Timestamp.Unix() != 1600000060 {
+		t.Errorf("Unexpected timestamp %v", m.Timestamp)
+	}
+
+	// invalid comment char
+	s = &Subscription{Measurement: "m", Value: "CSV 0", CSVComment: "//"}
+	_, err = s.Read("foo", "1,2")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestInvalidConditionFailsEveryRead(t *testing.T) {
+	s := &Subscription{Measurement: "m", When: `JSON "type" == `}
+	for i := 0; i < 2; i++ {
+		m, err := s.Read("foo", `{"type": "a"}`)
+		if err == nil {
+			t.Errorf("Read %d: expected error, got %v", i+1, m.Values)
+		}
+	}
+}
+
+func TestInvalidTopicRegexFailsEveryRead(t *testing.T) {
+	s := &Subscription{Measurement: "m", TopicRegex: `^foo/(?P<room>[a-z+)$`}
+	for i := 0; i < 2; i++ {
+		m, err := s.Read("foo/kitchen", "1")
+		if err == nil {
+			t.Errorf("Read %d: expected error, got %v", i+1, m.Values)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package mqttinflux
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -13,15 +15,23 @@ type MQTTService struct {
 	subs   []Subscription
 	client mqtt.Client
 	influx *InfluxService
+	// Home Assistant discovery
+	discoveryPrefix string
+	discovered      map[string]*Subscription // by discovery topic
+	mutex           sync.Mutex
 }
 
 // NewMQTTService creates a new MQTTService based on the given `config`.
 func NewMQTTService(config Config, influx *InfluxService) *MQTTService {
 	uri := fmt.Sprintf("tcp://%v:%v", config.MQTTHost, config.MQTTPort)
 	service := &MQTTService{
-		uri:    uri,
-		subs:   make([]Subscription, 0),
-		influx: influx,
+		uri:        uri,
+		subs:       make([]Subscription, 0),
+		influx:     influx,
+		discovered: make(map[string]*Subscription),
+	}
+	if config.HomeAssistant {
+		service.discoveryPrefix = strings.TrimSuffix(config.HomeAssistantPrefix, "/")
 	}
 
 	opts := mqtt.NewClientOptions()
@@ -69,11 +79,7 @@ func (m *MQTTService) subscribe() error {
 		logMQTTSubscribe(sub.Topic)
 		s := sub // local var for scope
 		t := m.client.Subscribe(s.Topic, qos, func(c mqtt.Client, msg mqtt.Message) {
-			mmt, e := s.Read(msg.Topic(), string(msg.Payload()))
-			if e != nil {
-				logMQTTHandlingError(msg.Topic(), e)
-			}
-			m.influx.Submit(&mmt)
+			m.handle(&s, msg)
 		})
 		t.Wait() // no timeout
 		err = t.Error()
@@ -81,14 +87,33 @@ func (m *MQTTService) subscribe() error {
 			return err
 		}
 	}
+
+	if m.discoveryPrefix != "" {
+		return m.subscribeDiscovery()
+	}
 	return nil
 }
 
+// handle reads measurements from an MQTT message and submits them to InfluxDB.
+func (m *MQTTService) handle(s *Subscription, msg mqtt.Message) {
+	measurements, err := s.ReadAll(msg.Topic(), string(msg.Payload()))
+	if err != nil {
+		logMQTTHandlingError(msg.Topic(), err)
+	}
+	for i := range measurements {
+		m.influx.Submit(&measurements[i])
+	}
+}
+
 func (m *MQTTService) unsubscribe() {
 	for _, sub := range m.subs {
 		logMQTTUnsubscribe(sub.Topic)
 		m.client.Unsubscribe(sub.Topic)
 	}
+
+	if m.discoveryPrefix != "" {
+		m.unsubscribeDiscovery()
+	}
 }
 
 // Register the given subscriptions. The MQTT service will subscribe to the
@@ -103,6 +128,129 @@ func (m *MQTTService) Register(subs []Subscription) {
 
 func (m *MQTTService) clearSubscriptions() {
 	m.subs = make([]Subscription, 0)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.discovered = make(map[string]*Subscription)
+}
+
+// Home Assistant Discovery ---------------------------------------------------
+
+// subscribeDiscovery subscribes to Home Assistant discovery messages
+// and to the state topics of entities which were discovered earlier.
+func (m *MQTTService) subscribeDiscovery() error {
+	topic := m.discoveryPrefix + "/#"
+	logMQTTSubscribe(topic)
+	t := m.client.Subscribe(topic, 0, m.onDiscovery)
+	t.Wait() // no timeout
+	if t.Error() != nil {
+		return t.Error()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	subscribed := make(map[string]bool)
+	for _, s := range m.discovered {
+		if !subscribed[s.Topic] {
+			m.subscribeState(s.Topic)
+			subscribed[s.Topic] = true
+		}
+	}
+	return nil
+}
+
+func (m *MQTTService) unsubscribeDiscovery() {
+	topic := m.discoveryPrefix + "/#"
+	logMQTTUnsubscribe(topic)
+	m.client.Unsubscribe(topic)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.discovered {
+		m.client.Unsubscribe(s.Topic)
+	}
+}
+
+// onDiscovery is the callback for Home Assistant discovery messages.
+// It creates, updates or removes the subscription for the entity.
+func (m *MQTTService) onDiscovery(c mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+	if !strings.HasSuffix(topic, "/config") {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	previous, known := m.discovered[topic]
+
+	// an empty config removes the entity
+	if len(msg.Payload()) == 0 {
+		if known {
+			delete(m.discovered, topic)
+			m.releaseState(previous.Topic)
+			logMQTTDiscoveryRemoved(topic)
+		}
+		return
+	}
+
+	sub, err := homeAssistantSubscription(m.discoveryPrefix, topic, msg.Payload())
+	if err == ErrSkipped {
+		return
+	} else if err != nil {
+		logMQTTDiscoveryError(topic, err)
+		return
+	}
+
+	m.discovered[topic] = &sub
+	if known && previous.Topic != sub.Topic {
+		m.releaseState(previous.Topic)
+	}
+	logMQTTDiscovered(topic, sub.Topic)
+	m.subscribeState(sub.Topic)
+}
+
+// onState is the callback for the state topics of discovered entities.
+// Several entities can share the same state topic.
+func (m *MQTTService) onState(c mqtt.Client, msg mqtt.Message) {
+	var subs []*Subscription
+	m.mutex.Lock()
+	for _, s := range m.discovered {
+		if s.Topic == msg.Topic() {
+			subs = append(subs, s)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, s := range subs {
+		m.handle(s, msg)
+	}
+}
+
+// subscribeState subscribes to the state topic of a discovered entity.
+// This is called from within a message handler, so we must not wait
+// for the subscription to complete.
+func (m *MQTTService) subscribeState(topic string) {
+	logMQTTSubscribe(topic)
+	t := m.client.Subscribe(topic, 0, m.onState)
+	go func() {
+		t.Wait()
+		if t.Error() != nil {
+			logMQTTDiscoveryError(topic, t.Error())
+		}
+	}()
+}
+
+// releaseState unsubscribes from a state topic
+// unless it is still used by another entity.
+func (m *MQTTService) releaseState(topic string) {
+	for _, s := range m.discovered {
+		if s.Topic == topic {
+			return
+		}
+	}
+	logMQTTUnsubscribe(topic)
+	m.client.Unsubscribe(topic)
 }
 
 // OnConnect is the callback for an established connection.
@@ -148,6 +296,18 @@ func logMQTTRegisteredSubscriptions() {
 	LogInfo("MQTT registered subscriptions")
 }
 
+func logMQTTDiscovered(topic, stateTopic string) {
+	LogInfo("MQTT discovered entity '%v' with state topic '%v'", topic, stateTopic)
+}
+
+func logMQTTDiscoveryRemoved(topic string) {
+	LogInfo("MQTT removed entity '%v'", topic)
+}
+
+func logMQTTDiscoveryError(topic string, err error) {
+	LogWarning("MQTT discovery failed for '%v': %v", topic, err)
+}
+
 func logMQTTHandlingError(topic string, err error) {
 	LogError("MQTT Failed to handle message '%v': %v", topic, err)
 }
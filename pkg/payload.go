@@ -0,0 +1,537 @@
+package mqttinflux
+
+// Decode binary payload formats into the same structure that is produced
+// by decoding JSON, so that they can be used with the `.JSON` templates:
+//
+//    objects  map[string]interface{}
+//    arrays   []interface{}
+//    numbers  float64 (json.Number in JSON, to keep large integers exact)
+//    strings  string
+//    booleans bool
+//    null     nil
+//
+// Binary data is represented as a base64 encoded string.
+//
+// MessagePack: https://github.com/msgpack/msgpack/blob/master/spec.md
+// CBOR: https://tools.ietf.org/html/rfc8949
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload formats
+const (
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+	formatCBOR    = "cbor"
+)
+
+// maximum nesting of arrays and maps in binary formats
+const maxDepth = 100
+
+// decodePayload decodes the payload in the given format.
+func decodePayload(format, payload string) (interface{}, error) {
+	var data interface{}
+	var err error
+	switch format {
+	case "", formatJSON:
+		dec := json.NewDecoder(strings.NewReader(payload))
+		dec.UseNumber()
+		err = dec.Decode(&data)
+	case formatMsgpack:
+		data, err = decodeBinary(&msgpackDecoder{buf: []byte(payload)})
+	case formatCBOR:
+		data, err = decodeBinary(&cborDecoder{buf: []byte(payload)})
+	default:
+		err = fmt.Errorf("unsupported payload format %q", format)
+	}
+	return data, err
+}
+
+type binaryDecoder interface {
+	decode(depth int) (interface{}, error)
+	done() bool
+}
+
+func decodeBinary(d binaryDecoder) (interface{}, error) {
+	data, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if !d.done() {
+		return nil, errors.New("unexpected data after payload")
+	}
+	return data, nil
+}
+
+// formatDecoded returns the string representation for a decoded value.
+// Numbers are formatted without exponent, integers from JSON are
+// formatted exactly.
+func formatDecoded(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		if _, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return v.String()
+		}
+		if _, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return v.String()
+		}
+		if f, err := v.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return v.String()
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// decodedNumber returns a number from JSON as float64,
+// other values are returned unchanged.
+func decodedNumber(value interface{}) interface{} {
+	if n, ok := value.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+// byteReader reads from a binary payload.
+type byteReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *byteReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *byteReader) read(n uint64) ([]byte, error) {
+	if n > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *byteReader) byte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// uint reads a big endian unsigned integer with `n` bytes.
+func (r *byteReader) uint(n int) (uint64, error) {
+	b, err := r.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return value, nil
+}
+
+func mapKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return formatDecoded(key)
+}
+
+// MessagePack -----------------------------------------------------------------
+
+type msgpackDecoder byteReader
+
+func (d *msgpackDecoder) done() bool {
+	return (*byteReader)(d).done()
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("payload nested too deeply")
+	}
+
+	r := (*byteReader)(d)
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return float64(b), nil
+	case b >= 0xe0:
+		return float64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.decodeMap(uint64(b&0x0f), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.decodeArray(uint64(b&0x0f), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		s, err := r.read(uint64(b & 0x1f))
+		return string(s), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		data, err := d.readSized(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		bits, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := r.uint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := r.uint(1 << (b - 0xcc))
+		return float64(value), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		value, err := r.uint(size)
+		// sign extension
+		shift := uint(64 - 8*size)
+		return float64(int64(value<<shift) >> shift), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		s, err := d.readSized(1 << (b - 0xd9))
+		return string(s), err
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("invalid MessagePack type 0x%02x", b)
+}
+
+// readSized reads data prefixed with its length (`size` bytes).
+func (d *msgpackDecoder) readSized(size int) ([]byte, error) {
+	r := (*byteReader)(d)
+	n, err := r.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	return r.read(n)
+}
+
+func (d *msgpackDecoder) decodeArray(n uint64, depth int) (interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = value
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n uint64, depth int) (interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	obj := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		obj[mapKey(key)] = value
+	}
+	return obj, nil
+}
+
+// decodeExt reads an extension type with `n` bytes of data.
+// Only timestamps are supported, they are returned as RFC 3339 strings.
+func (d *msgpackDecoder) decodeExt(n uint64) (interface{}, error) {
+	r := (*byteReader)(d)
+	extType, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(extType) != -1 {
+		return nil, fmt.Errorf("unsupported MessagePack extension type %v", int8(extType))
+	}
+
+	var ts time.Time
+	switch n {
+	case 4:
+		ts = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+	case 8:
+		value := binary.BigEndian.Uint64(data)
+		ts = time.Unix(int64(value&0x3ffffffff), int64(value>>34))
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		ts = time.Unix(sec, int64(nsec))
+	default:
+		return nil, fmt.Errorf("invalid MessagePack timestamp length %v", n)
+	}
+	return ts.UTC().Format(time.RFC3339Nano), nil
+}
+
+// CBOR -----------------------------------------------------------------------
+
+type cborDecoder byteReader
+
+// marker for the end of indefinite length items
+type cborBreak struct{}
+
+func (d *cborDecoder) done() bool {
+	return (*byteReader)(d).done()
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	value, err := d.decodeItem(depth)
+	if _, ok := value.(cborBreak); ok {
+		return nil, errors.New("unexpected CBOR break")
+	}
+	return value, err
+}
+
+func (d *cborDecoder) decodeItem(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("payload nested too deeply")
+	}
+
+	r := (*byteReader)(d)
+	b, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if major == 7 {
+		return d.decodeSimple(info)
+	}
+
+	indefinite := info == 31
+	var arg uint64
+	if !indefinite {
+		arg, err = d.argument(info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch major {
+	case 0:
+		return float64(arg), nil
+	case 1:
+		return -1 - float64(arg), nil
+	case 2, 3:
+		var data []byte
+		if indefinite {
+			data, err = d.readChunks(major)
+		} else {
+			data, err = r.read(arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(data), nil
+		}
+		return string(data), nil
+	case 4:
+		return d.decodeArray(arg, indefinite, depth)
+	case 5:
+		return d.decodeMap(arg, indefinite, depth)
+	case 6:
+		// tags (e.g. for dates or big numbers) are ignored,
+		// the tagged value is used as it is
+		if indefinite {
+			return nil, errors.New("invalid CBOR tag")
+		}
+		return d.decode(depth + 1)
+	}
+	return nil, fmt.Errorf("invalid CBOR item 0x%02x", b)
+}
+
+// argument reads the argument for the additional information `info`.
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	r := (*byteReader)(d)
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info == 24:
+		return r.uint(1)
+	case info == 25:
+		return r.uint(2)
+	case info == 26:
+		return r.uint(4)
+	case info == 27:
+		return r.uint(8)
+	}
+	return 0, fmt.Errorf("invalid CBOR additional information %v", info)
+}
+
+func (d *cborDecoder) decodeSimple(info byte) (interface{}, error) {
+	r := (*byteReader)(d)
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		// null, undefined
+		return nil, nil
+	case 25:
+		bits, err := r.uint(2)
+		return halfFloat(uint16(bits)), err
+	case 26:
+		bits, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 27:
+		bits, err := r.uint(8)
+		return math.Float64frombits(bits), err
+	case 31:
+		return cborBreak{}, nil
+	}
+	return nil, fmt.Errorf("unsupported CBOR simple value %v", info)
+}
+
+// readChunks reads an indefinite length byte or text string.
+func (d *cborDecoder) readChunks(major byte) ([]byte, error) {
+	r := (*byteReader)(d)
+	var data []byte
+	for {
+		b, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0xff {
+			return data, nil
+		}
+		if b>>5 != major || b&0x1f == 31 {
+			return nil, errors.New("invalid CBOR string chunk")
+		}
+		n, err := d.argument(b & 0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := r.read(n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func (d *cborDecoder) decodeArray(n uint64, indefinite bool, depth int) (interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	arr := make([]interface{}, 0, n)
+	for i := uint64(0); indefinite || i < n; i++ {
+		value, err := d.decodeItem(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(cborBreak); ok {
+			if indefinite {
+				break
+			}
+			return nil, errors.New("unexpected CBOR break")
+		}
+		arr = append(arr, value)
+	}
+	return arr, nil
+}
+
+func (d *cborDecoder) decodeMap(n uint64, indefinite bool, depth int) (interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+	obj := make(map[string]interface{}, n)
+	for i := uint64(0); indefinite || i < n; i++ {
+		key, err := d.decodeItem(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := key.(cborBreak); ok {
+			if indefinite {
+				break
+			}
+			return nil, errors.New("unexpected CBOR break")
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		obj[mapKey(key)] = value
+	}
+	return obj, nil
+}
+
+// halfFloat converts an IEEE 754 half precision float.
+func halfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+	var value float64
+	switch exp {
+	case 0:
+		value = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mant+1024, exp-25)
+	}
+	if bits&0x8000 != 0 {
+		value = -value
+	}
+	return value
+}
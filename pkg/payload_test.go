@@ -0,0 +1,164 @@
+package mqttinflux
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func float64Bytes(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+func uint64Bytes(u uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, u)
+	return b
+}
+
+func concat(parts ...[]byte) string {
+	var result []byte
+	for _, p := range parts {
+		result = append(result, p...)
+	}
+	return string(result)
+}
+
+// {"temp": 21.5, "n": -3, "ok": true, "arr": [1, 300], "name": "x", "big": 1600000000123}
+var msgpackPayload = concat(
+	[]byte{0x86},
+	[]byte("\xa4temp\xcb"), float64Bytes(21.5),
+	[]byte("\xa1n\xfd"),
+	[]byte("\xa2ok\xc3"),
+	[]byte("\xa3arr\x92\x01\xcd\x01\x2c"),
+	[]byte("\xa4name\xa1x"),
+	[]byte("\xa3big\xcf"), uint64Bytes(1600000000123),
+)
+
+var cborPayload = concat(
+	[]byte{0xa6},
+	[]byte("\x64temp\xfb"), float64Bytes(21.5),
+	[]byte("\x61n\x22"),
+	[]byte("\x62ok\xf5"),
+	[]byte("\x63arr\x9f\x01\x19\x01\x2c\xff"), // indefinite length
+	[]byte("\x64name\x61x"),
+	[]byte("\x63big\x1b"), uint64Bytes(1600000000123),
+)
+
+func TestPayloadFormats(t *testing.T) {
+	expected := map[string]string{
+		"temp":  "21.5",
+		"n":     "-3",
+		"ok":    "true",
+		"arr.1": "300",
+		"name":  "x",
+		"big":   "1600000000123",
+	}
+
+	payloads := map[string]string{
+		"msgpack": msgpackPayload,
+		"cbor":    cborPayload,
+	}
+
+	for format, payload := range payloads {
+		s := &Subscription{PayloadFormat: format}
+		ctx := NewTemplateContext(s, "foo/bar", payload)
+		for path, value := range expected {
+			result, err := ctx.JSON(path)
+			if err != nil {
+				t.Errorf("%v, path %v: %v", format, path, err)
+			} else if result != value {
+				t.Errorf("%v, path %v: expected %q, got %q", format, path, value, result)
+			}
+		}
+	}
+}
+
+func TestPayloadFormatSubscription(t *testing.T) {
+	s := &Subscription{
+		Measurement:   "test",
+		PayloadFormat: "msgpack",
+		Value:         "JSON \"big\"",
+		Conversion:    Conversion{Kind: "integer"},
+	}
+
+	m, err := s.Read("foo/bar", msgpackPayload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != int64(1600000000123) {
+		t.Errorf("Expected 1600000000123i, got %v", m.Values["value"])
+	}
+
+	s = &Subscription{PayloadFormat: "xml"}
+	_, err = s.Read("foo/bar", "<xml/>")
+	if err == nil {
+		t.Error("Expected error, got OK")
+	}
+}
+
+func TestCBORValues(t *testing.T) {
+	cases := map[string]interface{}{
+		"\xf9\x3e\x00":             1.5,  // half float
+		"\xf9\xc4\x00":             -4.0, // half float
+		"\xfa\x3f\xc0\x00\x00":     1.5,  // float32
+		"\x38\x63":                 -100.0,
+		"\xf6":                     nil,
+		"\xc1\x1a\x5f\x5e\x10\x00": 1600000000.0, // tagged epoch
+		"\x7f\x62ab\x61c\xff":      "abc",        // indefinite text
+		"\x43\x01\x02\x03":         "AQID",       // bytes as base64
+	}
+
+	for payload, expected := range cases {
+		value, err := decodePayload("cbor", payload)
+		if err != nil {
+			t.Errorf("Decoding %x: %v", payload, err)
+		} else if value != expected {
+			t.Errorf("Decoding %x: expected %v, got %v", payload, expected, value)
+		}
+	}
+}
+
+func TestBinaryPayloadErrors(t *testing.T) {
+	invalid := map[string][]string{
+		"msgpack": {
+			"",
+			"\x92\x01",         // array too short
+			"\xa5abc",          // string too short
+			"\xc1",             // never used
+			"\xd4\x01\x00",     // unsupported extension
+			"\x01\x02",         // trailing data
+			"\xdd\xff\xff\xff", // truncated length
+		},
+		"cbor": {
+			"",
+			"\x82\x01",     // array too short
+			"\x1c",         // reserved
+			"\xff",         // break
+			"\x9f\x01",     // missing break
+			"\x01\x02",     // trailing data
+			"\x7f\x01\xff", // invalid chunk
+		},
+	}
+
+	for format, payloads := range invalid {
+		for _, payload := range payloads {
+			_, err := decodePayload(format, payload)
+			if err == nil {
+				t.Errorf("%v: expected error for %x, got OK", format, payload)
+			}
+		}
+	}
+}
+
+func TestMsgpackTimestamp(t *testing.T) {
+	value, err := decodePayload("msgpack", "\xd6\xff\x5f\x5e\x10\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "2020-09-13T12:26:40Z" {
+		t.Errorf("Unexpected timestamp %v", value)
+	}
+}
@@ -0,0 +1,154 @@
+package mqttinflux
+
+// Presets for the JSON payloads of popular device firmwares.
+//
+// Zigbee2MQTT publishes the state of each device as a flat JSON object:
+//
+//    zigbee2mqtt/<friendly_name>    {"temperature": 21.5, "battery": 97, ...}
+//
+// Tasmota publishes sensor readings as nested JSON objects:
+//
+//    tele/<device>/SENSOR           {"Time": "...", "AM2301": {"Temperature": 21.5}}
+//
+// All numeric and boolean values are written as fields of a single
+// measurement, the payload is flattened (see `Flatten`) with presets
+// which skip strings and housekeeping values.
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	presetZigbee2MQTT = "zigbee2mqtt"
+	presetTasmota     = "tasmota"
+)
+
+// preset describes how to read the payload of a device firmware.
+type preset struct {
+	// device returns the device name for a topic,
+	// or false if the topic should be ignored.
+	device func(base, parts []string) (string, bool)
+	// default options for flattening the payload
+	flatten Flatten
+}
+
+var presets = map[string]preset{
+	presetZigbee2MQTT: {
+		device: zigbee2MQTTDevice,
+		flatten: Flatten{
+			Exclude:     []string{"device", "elapsed", "last_seen", "update", "update_available"},
+			SkipStrings: true,
+		},
+	},
+	presetTasmota: {
+		device: tasmotaDevice,
+		flatten: Flatten{
+			Exclude:     []string{"Time", "TempUnit", "PressureUnit", "SpeedUnit"},
+			SkipStrings: true,
+		},
+	},
+}
+
+// zigbee2MQTTDevice returns the friendly name from a topic like
+// "zigbee2mqtt/<friendly_name>".
+// Messages from the bridge, commands and availability are ignored.
+func zigbee2MQTTDevice(base, parts []string) (string, bool) {
+	if len(parts) <= len(base) {
+		return "", false
+	}
+	rel := parts[len(base):]
+	switch {
+	case rel[0] == "bridge":
+		return "", false
+	case len(rel) > 1:
+		switch rel[len(rel)-1] {
+		case "set", "get", "availability":
+			return "", false
+		}
+	}
+	return strings.Join(rel, "/"), true
+}
+
+// tasmotaDevice returns the device from a topic like "tele/<device>/SENSOR"
+// or "<device>/tele/SENSOR".
+// Other telemetry (STATE, LWT, ...) is ignored.
+func tasmotaDevice(base, parts []string) (string, bool) {
+	n := len(parts)
+	if n < 2 || parts[n-1] != "SENSOR" {
+		return "", false
+	}
+	device := parts[n-2]
+	if device == "tele" && n > 2 {
+		device = parts[n-3]
+	}
+	return device, true
+}
+
+// readPreset creates a Measurement with one field for each numeric or
+// boolean value in the payload.
+// The preset's options for flattening can be replaced with `Flatten`.
+func (s *Subscription) readPreset(ctx TemplateContext) ([]Measurement, error) {
+	p := presets[s.Preset]
+	base := strings.Split(strings.TrimSuffix(strings.TrimSuffix(s.Topic, "/#"), "/+"), "/")
+	device, ok := p.device(base, ctx.Parts)
+	if !ok {
+		return nil, nil
+	}
+
+	doc, err := ctx.document()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("expected a JSON object, got %T", doc)
+	}
+
+	if !s.matches(ctx) {
+		return nil, nil
+	}
+
+	measurementName := s.Preset
+	if s.Measurement != "" {
+		measurementName, err = s.fillTemplate("measurement", ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m := NewMeasurement(s.Database, measurementName)
+
+	flatten := &p.flatten
+	if s.Flatten != nil {
+		flatten = s.Flatten
+	}
+	data, err := ctx.flattenData(flatten.Path)
+	if err != nil {
+		return nil, err
+	}
+	flatten.flattenFields(&m, data)
+	if len(m.Values) == 0 {
+		return nil, nil
+	}
+
+	m.Tag("device", sanitizeName(device))
+	tags, err := s.fillTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for tag, tagValue := range tags {
+		m.Tag(tag, tagValue)
+	}
+
+	if s.Timestamp != "" {
+		rawTimestamp, err := s.fillTemplate("timestamp", ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.Timestamp, err = parseTimestamp(rawTimestamp, s.TimestampPrecision)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []Measurement{m}, nil
+}
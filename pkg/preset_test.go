@@ -0,0 +1,132 @@
+package mqttinflux
+
+import (
+	"testing"
+)
+
+func TestPresetZigbee2MQTT(t *testing.T) {
+	s := &Subscription{
+		Topic:  "zigbee2mqtt/#",
+		Preset: "zigbee2mqtt",
+	}
+
+	payload := `{
+		"temperature": 21.5,
+		"humidity": 40,
+		"contact": false,
+		"state": "ON",
+		"color": {"x": 0.3, "y": 0.4},
+		"last_seen": 1600000000000,
+		"update": {"state": "idle", "progress": 10}
+	}`
+	measurements, err := s.ReadAll("zigbee2mqtt/Living Room", payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 {
+		t.Fatalf("Expected 1 measurement, got %v", len(measurements))
+	}
+
+	m := measurements[0]
+	if m.Name != "zigbee2mqtt" {
+		t.Errorf("Unexpected measurement %q", m.Name)
+	}
+	if m.Tags["device"] != "Living_Room" {
+		t.Errorf("Unexpected device tag %q", m.Tags["device"])
+	}
+	expected := map[string]interface{}{
+		"temperature": 21.5,
+		"humidity":    40.0,
+		"contact":     false,
+		"color.x":     0.3,
+		"color.y":     0.4,
+	}
+	if len(m.Values) != len(expected) {
+		t.Errorf("Expected %v fields, got %v", len(expected), m.Values)
+	}
+	for name, value := range expected {
+		if m.Values[name] != value {
+			t.Errorf("Field %v: expected %v, got %v", name, value, m.Values[name])
+		}
+	}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Invalid measurement: %v", err)
+	}
+
+	ignored := []string{
+		"zigbee2mqtt/bridge/state",
+		"zigbee2mqtt/Living Room/set",
+		"zigbee2mqtt/Living Room/availability",
+	}
+	for _, topic := range ignored {
+		measurements, err := s.ReadAll(topic, `{"state": "online", "value": 1}`)
+		if err != nil || len(measurements) != 0 {
+			t.Errorf("Expected %v to be ignored, got %v, %v", topic, measurements, err)
+		}
+	}
+}
+
+func TestPresetTasmota(t *testing.T) {
+	s := &Subscription{
+		Topic:       "tele/+/SENSOR",
+		Preset:      "tasmota",
+		Measurement: "sensors",
+	}
+
+	payload := `{
+		"Time": "2021-01-01T12:00:00",
+		"AM2301": {"Temperature": 21.5, "Humidity": 40.1},
+		"ENERGY": {"TotalStartTime": "2020-12-01T00:00:00", "Power": 12},
+		"TempUnit": "C"
+	}`
+	measurements, err := s.ReadAll("tele/plug-1/SENSOR", payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 {
+		t.Fatalf("Expected 1 measurement, got %v", len(measurements))
+	}
+
+	m := measurements[0]
+	if m.Name != "sensors" {
+		t.Errorf("Unexpected measurement %q", m.Name)
+	}
+	if m.Tags["device"] != "plug-1" {
+		t.Errorf("Unexpected device tag %q", m.Tags["device"])
+	}
+	expected := map[string]interface{}{
+		"AM2301.Temperature": 21.5,
+		"AM2301.Humidity":    40.1,
+		"ENERGY.Power":       12.0,
+	}
+	if len(m.Values) != len(expected) {
+		t.Errorf("Expected %v fields, got %v", len(expected), m.Values)
+	}
+	for name, value := range expected {
+		if m.Values[name] != value {
+			t.Errorf("Field %v: expected %v, got %v", name, value, m.Values[name])
+		}
+	}
+
+	measurements, err = s.ReadAll("tele/plug-1/STATE", `{"Uptime": "1T00:00:00", "Heap": 25}`)
+	if err != nil || len(measurements) != 0 {
+		t.Errorf("Expected STATE to be ignored, got %v, %v", measurements, err)
+	}
+
+	_, err = s.ReadAll("tele/plug-1/SENSOR", `[1, 2]`)
+	if err == nil {
+		t.Error("Expected error for array payload, got OK")
+	}
+}
+
+func TestPresetInvalid(t *testing.T) {
+	subs := []Subscription{
+		{Topic: "foo/#", Preset: "shelly"},
+		{Topic: "foo/#", Preset: "tasmota", Mode: "lineprotocol"},
+	}
+	for _, s := range subs {
+		if err := s.parseTemplates(); err == nil {
+			t.Errorf("Expected error for %v, got OK", s)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package mqttinflux
+
+// Decode Eclipse Sparkplug B payloads.
+// See: https://www.eclipse.org/tahu/spec/Sparkplug%20Topic%20Namespace%20and%20State%20ManagementV2.2-with%20appendix%20B%20format%20-%20Eclipse.pdf
+//
+// Topics have the form:
+//
+//    spBv1.0/<group_id>/<message_type>/<edge_node_id>[/<device_id>]
+//
+// Payloads are protocol buffers. Only the parts of the schema which are
+// needed to read metrics are decoded:
+//
+//    message Payload {
+//        optional uint64 timestamp = 1;
+//        repeated Metric metrics   = 2;
+//        optional uint64 seq       = 3;
+//    }
+//
+//    message Metric {
+//        optional string name      = 1;
+//        optional uint64 alias     = 2;
+//        optional uint64 timestamp = 3;
+//        optional uint32 datatype  = 4;
+//        optional bool   is_null   = 7;
+//        oneof value {
+//            uint32 int_value     = 10;
+//            uint64 long_value    = 11;
+//            float  float_value   = 12;
+//            double double_value  = 13;
+//            bool   boolean_value = 14;
+//            string string_value  = 15;
+//        }
+//    }
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const modeSparkplug = "sparkplug"
+
+// Sparkplug B data types
+const (
+	spInt8     = 1
+	spInt16    = 2
+	spInt32    = 3
+	spInt64    = 4
+	spUInt8    = 5
+	spUInt16   = 6
+	spUInt32   = 7
+	spUInt64   = 8
+	spFloat    = 9
+	spDouble   = 10
+	spBoolean  = 11
+	spString   = 12
+	spDateTime = 13
+	spText     = 14
+	spUUID     = 15
+)
+
+var invalidNameChars = regexp.MustCompile("[^a-zA-Z0-9\\-_\\.]+")
+
+type sparkplugPayload struct {
+	timestamp uint64
+	metrics   []sparkplugMetric
+}
+
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	value     interface{}
+}
+
+// birthMetric is the name and datatype of a metric
+// from a birth certificate.
+type birthMetric struct {
+	name     string
+	datatype uint32
+}
+
+// sparkplugState keeps the metric aliases and datatypes from birth
+// certificates for each edge node. Data messages may leave out both.
+type sparkplugState struct {
+	mutex     sync.Mutex
+	aliases   map[string]map[uint64]birthMetric
+	datatypes map[string]map[string]uint32
+}
+
+func newSparkplugState() *sparkplugState {
+	return &sparkplugState{
+		aliases:   make(map[string]map[uint64]birthMetric),
+		datatypes: make(map[string]map[string]uint32),
+	}
+}
+
+// readSparkplug creates one Measurement for each metric in a Sparkplug B
+// message. The group, edge node and device IDs are added as tags.
+func (s *Subscription) readSparkplug(ctx TemplateContext) ([]Measurement, error) {
+	parts := ctx.Parts
+	if len(parts) > 1 && parts[0] == "spBv1.0" && parts[1] == "STATE" {
+		// status of the primary host application
+		return nil, nil
+	}
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != "spBv1.0" {
+		return nil, fmt.Errorf("not a Sparkplug B topic: %q", ctx.FullTopic)
+	}
+	group, messageType, node := parts[1], parts[2], parts[3]
+	device := ""
+	if len(parts) == 5 {
+		device = parts[4]
+	}
+	nodeKey := group + "/" + node
+
+	switch messageType {
+	case "NBIRTH", "DBIRTH", "NDATA", "DDATA":
+	case "NDEATH":
+		s.sparkplug.forget(nodeKey)
+		return nil, nil
+	default:
+		// commands and device death certificates have no data
+		return nil, nil
+	}
+
+	payload, err := decodeSparkplug([]byte(ctx.Payload))
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType == "NBIRTH" {
+		s.sparkplug.forget(nodeKey)
+	}
+	if messageType == "NBIRTH" || messageType == "DBIRTH" {
+		s.sparkplug.learn(nodeKey, device, payload.metrics)
+	}
+
+	var firstErr error
+	var measurements []Measurement
+	for _, metric := range payload.metrics {
+		m, err := s.readMetric(ctx, nodeKey, device, payload, metric)
+		if err == ErrSkipped {
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		m.Tag("group", group)
+		m.Tag("node", node)
+		if device != "" {
+			m.Tag("device", device)
+		}
+		measurements = append(measurements, m)
+	}
+
+	return measurements, firstErr
+}
+
+func (s *Subscription) readMetric(ctx TemplateContext, nodeKey, device string, payload sparkplugPayload, metric sparkplugMetric) (Measurement, error) {
+	var m Measurement
+	name, datatype := metric.name, metric.datatype
+	if name == "" && metric.hasAlias {
+		birth, ok := s.sparkplug.lookup(nodeKey, metric.alias)
+		if !ok {
+			return m, fmt.Errorf("unknown alias %v for edge node %q", metric.alias, nodeKey)
+		}
+		name = birth.name
+		if datatype == 0 {
+			datatype = birth.datatype
+		}
+	}
+	if datatype == 0 {
+		datatype = s.sparkplug.datatype(nodeKey, device, name)
+	}
+
+	// no value, or a type we do not support (datasets, templates, ...)
+	value := typedMetricValue(datatype, metric.value)
+	if metric.isNull || value == nil {
+		return m, ErrSkipped
+	}
+
+	ctx.item = &foreachItem{key: name, value: value}
+	if !s.matches(ctx) {
+		return m, ErrSkipped
+	}
+
+	measurementName := sanitizeName(name)
+	if s.Measurement != "" {
+		var err error
+		measurementName, err = s.fillTemplate("measurement", ctx)
+		if err != nil {
+			return m, err
+		}
+	}
+	m = NewMeasurement(s.Database, measurementName)
+
+	if s.Conversion.configured() {
+		var err error
+		value, err = s.Conversion.withContext(ctx).Convert(formatDecoded(value))
+		if err != nil {
+			return m, fmt.Errorf("metric %q: %v", name, err)
+		}
+	}
+	m.SetValue(value)
+
+	tags, err := s.fillTags(ctx)
+	if err != nil {
+		return m, err
+	}
+	for tag, tagValue := range tags {
+		m.Tag(tag, tagValue)
+	}
+
+	timestamp := metric.timestamp
+	if timestamp == 0 {
+		timestamp = payload.timestamp
+	}
+	if timestamp != 0 {
+		m.Timestamp = time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+	}
+
+	return m, nil
+}
+
+func (st *sparkplugState) learn(nodeKey, device string, metrics []sparkplugMetric) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	aliases, ok := st.aliases[nodeKey]
+	if !ok {
+		aliases = make(map[uint64]birthMetric)
+		st.aliases[nodeKey] = aliases
+	}
+	datatypes, ok := st.datatypes[nodeKey]
+	if !ok {
+		datatypes = make(map[string]uint32)
+		st.datatypes[nodeKey] = datatypes
+	}
+	for _, metric := range metrics {
+		if metric.name == "" {
+			continue
+		}
+		if metric.hasAlias {
+			aliases[metric.alias] = birthMetric{name: metric.name, datatype: metric.datatype}
+		}
+		datatypes[device+"/"+metric.name] = metric.datatype
+	}
+}
+
+func (st *sparkplugState) lookup(nodeKey string, alias uint64) (birthMetric, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	birth, ok := st.aliases[nodeKey][alias]
+	return birth, ok
+}
+
+// datatype returns the datatype of a metric from the birth certificate
+// of the edge node or device, or 0 if it is unknown.
+func (st *sparkplugState) datatype(nodeKey, device, name string) uint32 {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.datatypes[nodeKey][device+"/"+name]
+}
+
+func (st *sparkplugState) forget(nodeKey string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.aliases, nodeKey)
+	delete(st.datatypes, nodeKey)
+}
+
+// Protobuf -------------------------------------------------------------------
+
+func decodeSparkplug(data []byte) (sparkplugPayload, error) {
+	var payload sparkplugPayload
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.key()
+		if err != nil {
+			return payload, err
+		}
+
+		switch {
+		case field == 1 && wireType == wireVarint:
+			payload.timestamp, err = r.varint()
+		case field == 2 && wireType == wireBytes:
+			var raw []byte
+			raw, err = r.bytes()
+			if err == nil {
+				var metric sparkplugMetric
+				metric, err = decodeMetric(raw)
+				payload.metrics = append(payload.metrics, metric)
+			}
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return payload, fmt.Errorf("invalid Sparkplug payload: %v", err)
+		}
+	}
+	return payload, nil
+}
+
+func decodeMetric(data []byte) (sparkplugMetric, error) {
+	var metric sparkplugMetric
+	var raw uint64
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.key()
+		if err != nil {
+			return metric, err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var b []byte
+			b, err = r.bytes()
+			metric.name = string(b)
+		case field == 2 && wireType == wireVarint:
+			metric.alias, err = r.varint()
+			metric.hasAlias = true
+		case field == 3 && wireType == wireVarint:
+			metric.timestamp, err = r.varint()
+		case field == 4 && wireType == wireVarint:
+			raw, err = r.varint()
+			metric.datatype = uint32(raw)
+		case field == 7 && wireType == wireVarint:
+			raw, err = r.varint()
+			metric.isNull = raw != 0
+		case (field == 10 || field == 11) && wireType == wireVarint:
+			raw, err = r.varint()
+			metric.value = raw
+		case field == 12 && wireType == wireFixed32:
+			var bits uint32
+			bits, err = r.fixed32()
+			metric.value = float64(math.Float32frombits(bits))
+		case field == 13 && wireType == wireFixed64:
+			raw, err = r.fixed64()
+			metric.value = math.Float64frombits(raw)
+		case field == 14 && wireType == wireVarint:
+			raw, err = r.varint()
+			metric.value = raw != 0
+		case field == 15 && wireType == wireBytes:
+			var b []byte
+			b, err = r.bytes()
+			metric.value = string(b)
+		default:
+			err = r.skip(wireType)
+		}
+		if err != nil {
+			return metric, err
+		}
+	}
+
+	return metric, nil
+}
+
+// typedMetricValue applies the metric's datatype to integer values.
+// Values with an unsupported datatype are dropped.
+func typedMetricValue(datatype uint32, value interface{}) interface{} {
+	raw, isInt := value.(uint64)
+	switch datatype {
+	case spInt8:
+		if isInt {
+			return int64(int8(raw))
+		}
+	case spInt16:
+		if isInt {
+			return int64(int16(raw))
+		}
+	case spInt32:
+		if isInt {
+			return int64(int32(raw))
+		}
+	case spInt64, spDateTime:
+		if isInt {
+			return int64(raw)
+		}
+	case spUInt8, spUInt16, spUInt32, spUInt64:
+		if isInt {
+			return raw
+		}
+	case spFloat, spDouble:
+		if _, ok := value.(float64); ok {
+			return value
+		}
+	case spBoolean:
+		if _, ok := value.(bool); ok {
+			return value
+		}
+	case spString, spText, spUUID:
+		if _, ok := value.(string); ok {
+			return value
+		}
+	}
+	return nil
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("unexpected end of data")
+
+// protoReader reads values in the protocol buffers wire format.
+// See: https://developers.google.com/protocol-buffers/docs/encoding
+type protoReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+// key reads the field number and wire type for the next field.
+func (r *protoReader) key() (int, int, error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	var value uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if r.done() {
+			return 0, errTruncated
+		}
+		b := r.buf[r.pos]
+		r.pos++
+		value |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("varint overflow")
+}
+
+func (r *protoReader) fixed32() (uint32, error) {
+	if r.pos+4 > len(r.buf) {
+		return 0, errTruncated
+	}
+	b := r.buf[r.pos:]
+	r.pos += 4
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	lo, err := r.fixed32()
+	if err != nil {
+		return 0, err
+	}
+	hi, err := r.fixed32()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(lo) | uint64(hi)<<32, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncated
+	}
+	b := r.buf[r.pos : r.pos+int(length)]
+	r.pos += int(length)
+	return b, nil
+}
+
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = r.varint()
+	case wireFixed64:
+		_, err = r.fixed64()
+	case wireBytes:
+		_, err = r.bytes()
+	case wireFixed32:
+		_, err = r.fixed32()
+	default:
+		err = fmt.Errorf("unsupported wire type %v", wireType)
+	}
+	return err
+}
+
+// sanitizeName replaces characters which are not allowed in measurement
+// names with an underscore.
+func sanitizeName(name string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(name, "_"), "_")
+}
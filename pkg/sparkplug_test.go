@@ -0,0 +1,200 @@
+package mqttinflux
+
+import (
+	"math"
+	"testing"
+)
+
+// protoWriter encodes protocol buffers for tests.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) varint(field int, value uint64) *protoWriter {
+	w.rawVarint(uint64(field<<3 | wireVarint))
+	w.rawVarint(value)
+	return w
+}
+
+func (w *protoWriter) bytes(field int, value []byte) *protoWriter {
+	w.rawVarint(uint64(field<<3 | wireBytes))
+	w.rawVarint(uint64(len(value)))
+	w.buf = append(w.buf, value...)
+	return w
+}
+
+func (w *protoWriter) double(field int, value float64) *protoWriter {
+	w.rawVarint(uint64(field<<3 | wireFixed64))
+	bits := math.Float64bits(value)
+	for i := 0; i < 8; i++ {
+		w.buf = append(w.buf, byte(bits>>(8*i)))
+	}
+	return w
+}
+
+func (w *protoWriter) rawVarint(value uint64) {
+	for value >= 0x80 {
+		w.buf = append(w.buf, byte(value)|0x80)
+		value >>= 7
+	}
+	w.buf = append(w.buf, byte(value))
+}
+
+func TestSparkplug(t *testing.T) {
+	s := &Subscription{
+		Topic: "spBv1.0/#",
+		Mode:  "sparkplug",
+	}
+
+	temperature := new(protoWriter).
+		bytes(1, []byte("Sensors/Temperature")).
+		varint(2, 1).
+		varint(4, spDouble).
+		double(13, 21.5).buf
+	counter := new(protoWriter).
+		bytes(1, []byte("Counter")).
+		varint(2, 2).
+		varint(3, 1600000001000).
+		varint(4, spInt32).
+		varint(10, uint64(uint32(0xfffffffe))).buf
+	birth := new(protoWriter).
+		varint(1, 1600000000000).
+		bytes(2, temperature).
+		bytes(2, counter).buf
+
+	measurements, err := s.ReadAll("spBv1.0/plant/DBIRTH/edge1/dev1", string(birth))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", len(measurements))
+	}
+
+	m := measurements[0]
+	if m.Name != "Sensors_Temperature" || m.Values["value"] != 21.5 {
+		t.Errorf("Unexpected measurement %v", m)
+	}
+	if m.Tags["group"] != "plant" || m.Tags["node"] != "edge1" || m.Tags["device"] != "dev1" {
+		t.Errorf("Unexpected tags %v", m.Tags)
+	}
+	if m.Timestamp.UnixNano() != 1600000000000000000 {
+		t.Errorf("Unexpected timestamp %v", m.Timestamp)
+	}
+
+	m = measurements[1]
+	if m.Name != "Counter" || m.Values["value"] != int64(-2) {
+		t.Errorf("Unexpected measurement %v", m)
+	}
+	if m.Timestamp.UnixNano() != 1600000001000000000 {
+		t.Errorf("Unexpected timestamp %v", m.Timestamp)
+	}
+
+	// data message with alias only
+	byAlias := new(protoWriter).
+		varint(2, 1).
+		varint(4, spDouble).
+		double(13, 22).buf
+	data := new(protoWriter).bytes(2, byAlias).buf
+	measurements, err = s.ReadAll("spBv1.0/plant/DDATA/edge1/dev1", string(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 || measurements[0].Name != "Sensors_Temperature" {
+		t.Errorf("Unexpected measurements %v", measurements)
+	}
+
+	// the datatype is optional in data messages, take it from the birth
+	noType := new(protoWriter).
+		varint(2, 2).
+		varint(10, uint64(uint32(0xfffffffd))).buf
+	byName := new(protoWriter).
+		bytes(1, []byte("Sensors/Temperature")).
+		double(13, 23).buf
+	untyped := new(protoWriter).bytes(2, noType).bytes(2, byName).buf
+	measurements, err = s.ReadAll("spBv1.0/plant/DDATA/edge1/dev1", string(untyped))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %v", measurements)
+	}
+	if m := measurements[0]; m.Name != "Counter" || m.Values["value"] != int64(-3) {
+		t.Errorf("Unexpected measurement %v", m)
+	}
+	if m := measurements[1]; m.Name != "Sensors_Temperature" || m.Values["value"] != 23.0 {
+		t.Errorf("Unexpected measurement %v", m)
+	}
+
+	// aliases are forgotten after NDEATH
+	_, err = s.ReadAll("spBv1.0/plant/NDEATH/edge1", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = s.ReadAll("spBv1.0/plant/DDATA/edge1/dev1", string(data))
+	if err == nil {
+		t.Error("Expected error for unknown alias, got OK")
+	}
+}
+
+func TestSparkplugUnsigned(t *testing.T) {
+	s := &Subscription{Mode: "sparkplug"}
+	counter := new(protoWriter).
+		bytes(1, []byte("Bytes")).
+		varint(4, spUInt64).
+		varint(11, math.MaxUint64).buf
+	data := new(protoWriter).bytes(2, counter).buf
+
+	measurements, err := s.ReadAll("spBv1.0/plant/NDATA/edge1", string(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 {
+		t.Fatalf("Expected 1 measurement, got %v", measurements)
+	}
+	value := measurements[0].Values["value"]
+	if value != uint64(math.MaxUint64) {
+		t.Errorf("Expected unsigned %v, got %T %v", uint64(math.MaxUint64), value, value)
+	}
+	if formatFieldValue(value) != "18446744073709551615u" {
+		t.Errorf("Unexpected line protocol value %v", formatFieldValue(value))
+	}
+}
+
+func TestSparkplugConversion(t *testing.T) {
+	s := &Subscription{
+		Mode:       "sparkplug",
+		Conversion: Conversion{Kind: "regex", Pattern: `^[0-9]+$`},
+	}
+	total := new(protoWriter).
+		bytes(1, []byte("Total")).
+		varint(4, spDouble).
+		double(13, 1e21).buf
+	data := new(protoWriter).bytes(2, total).buf
+
+	measurements, err := s.ReadAll("spBv1.0/plant/NDATA/edge1", string(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(measurements) != 1 || measurements[0].Values["value"] != "1000000000000000000000" {
+		t.Errorf("Unexpected measurements %v", measurements)
+	}
+}
+
+func TestSparkplugErrors(t *testing.T) {
+	s := &Subscription{Mode: "sparkplug"}
+
+	_, err := s.ReadAll("spBv1.0/plant/NDATA/edge1", "\x12\x05\x0a")
+	if err == nil {
+		t.Error("Expected error for truncated payload, got OK")
+	}
+
+	_, err = s.ReadAll("foo/bar", "")
+	if err == nil {
+		t.Error("Expected error for invalid topic, got OK")
+	}
+
+	measurements, err := s.ReadAll("spBv1.0/STATE/host", "ONLINE")
+	if err != nil || len(measurements) != 0 {
+		t.Errorf("Expected STATE to be ignored, got %v (%v)", measurements, err)
+	}
+}
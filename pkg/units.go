@@ -0,0 +1,169 @@
+package mqttinflux
+
+// Conversion between physical units.
+//
+// Each unit is defined by its dimension and the factor and offset to
+// convert a value to the base unit of that dimension:
+//
+//    base = value * factor + offset
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type unit struct {
+	dimension string
+	factor    float64
+	offset    float64
+}
+
+var units = map[string]unit{
+	// temperature, base: °C
+	"°C":   {"temperature", 1, 0},
+	"C":    {"temperature", 1, 0},
+	"degC": {"temperature", 1, 0},
+	"°F":   {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"F":    {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"degF": {"temperature", 5.0 / 9.0, -32 * 5.0 / 9.0},
+	"K":    {"temperature", 1, -273.15},
+
+	// energy, base: Wh
+	"Wh":  {"energy", 1, 0},
+	"kWh": {"energy", 1e3, 0},
+	"MWh": {"energy", 1e6, 0},
+	"J":   {"energy", 1.0 / 3600, 0},
+	"kJ":  {"energy", 1e3 / 3600, 0},
+	"MJ":  {"energy", 1e6 / 3600, 0},
+
+	// power, base: W
+	"mW": {"power", 1e-3, 0},
+	"W":  {"power", 1, 0},
+	"kW": {"power", 1e3, 0},
+	"MW": {"power", 1e6, 0},
+
+	// pressure, base: Pa
+	"Pa":   {"pressure", 1, 0},
+	"hPa":  {"pressure", 100, 0},
+	"kPa":  {"pressure", 1e3, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 1e5, 0},
+	"atm":  {"pressure", 101325, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+	"inHg": {"pressure", 3386.389, 0},
+	"mmHg": {"pressure", 133.322387415, 0},
+
+	// length, base: m
+	"mm": {"length", 1e-3, 0},
+	"cm": {"length", 1e-2, 0},
+	"m":  {"length", 1, 0},
+	"km": {"length", 1e3, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+	"mi": {"length", 1609.344, 0},
+
+	// speed, base: m/s
+	"m/s":  {"speed", 1, 0},
+	"km/h": {"speed", 1 / 3.6, 0},
+	"mph":  {"speed", 0.44704, 0},
+	"kn":   {"speed", 1852.0 / 3600, 0},
+
+	// mass, base: kg
+	"g":  {"mass", 1e-3, 0},
+	"kg": {"mass", 1, 0},
+	"lb": {"mass", 0.45359237, 0},
+	"oz": {"mass", 0.028349523125, 0},
+
+	// volume, base: l
+	"ml":  {"volume", 1e-3, 0},
+	"l":   {"volume", 1, 0},
+	"L":   {"volume", 1, 0},
+	"m³":  {"volume", 1e3, 0},
+	"m3":  {"volume", 1e3, 0},
+	"gal": {"volume", 3.785411784, 0},
+
+	// voltage, base: V
+	"mV": {"voltage", 1e-3, 0},
+	"V":  {"voltage", 1, 0},
+	"kV": {"voltage", 1e3, 0},
+
+	// current, base: A
+	"mA": {"current", 1e-3, 0},
+	"A":  {"current", 1, 0},
+
+	// time, base: s
+	"ns":  {"time", 1e-9, 0},
+	"us":  {"time", 1e-6, 0},
+	"µs":  {"time", 1e-6, 0},
+	"ms":  {"time", 1e-3, 0},
+	"s":   {"time", 1, 0},
+	"min": {"time", 60, 0},
+	"h":   {"time", 3600, 0},
+	"d":   {"time", 86400, 0},
+}
+
+// a number, optionally followed by a unit
+var unitValuePattern = regexp.MustCompile(`^([-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?)\s*(.*)$`)
+
+// validateUnits checks the `From` and `To` units of a conversion.
+func validateUnits(from, to string) error {
+	target, ok := units[to]
+	if !ok {
+		return fmt.Errorf("unknown unit %q", to)
+	}
+	if from != "" {
+		source, ok := units[from]
+		if !ok {
+			return fmt.Errorf("unknown unit %q", from)
+		}
+		if source.dimension != target.dimension {
+			return fmt.Errorf("cannot convert %v (%v) to %v (%v)", from, source.dimension, to, target.dimension)
+		}
+	}
+	return nil
+}
+
+// convertUnit converts `value` from one unit to another.
+func convertUnit(value float64, from, to string) (float64, error) {
+	err := validateUnits(from, to)
+	if err != nil {
+		return 0, err
+	}
+	source, target := units[from], units[to]
+	base := value*source.factor + source.offset
+	return (base - target.offset) / target.factor, nil
+}
+
+// Unit converts a value with an optional unit suffix (e.g. "21.5 °C")
+// to the unit given in `To`.
+// Values without a suffix are in the unit given in `From`.
+func Unit(raw string, params *Conversion) (interface{}, error) {
+	groups := unitValuePattern.FindStringSubmatch(strings.TrimSpace(raw))
+	if groups == nil {
+		return nil, fmt.Errorf("not a number: %q", raw)
+	}
+
+	value, err := strconv.ParseFloat(groups[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	from := groups[2]
+	if from == "" {
+		from = params.From
+	}
+	if from == "" {
+		return nil, fmt.Errorf("no unit for %q", raw)
+	}
+
+	converted, err := convertUnit(value, from, params.To)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Precision != 0 {
+		converted = roundPrecision(converted, params.Precision)
+	}
+	return converted, nil
+}
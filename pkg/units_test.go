@@ -0,0 +1,75 @@
+package mqttinflux
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertUnit(t *testing.T) {
+	cases := []struct {
+		raw      string
+		from, to string
+		expected float64
+	}{
+		{"21.5 °C", "", "°F", 70.7},
+		{"70.7°F", "", "C", 21.5},
+		{"0", "K", "°C", -273.15},
+		{"1500", "Wh", "kWh", 1.5},
+		{"2.5 kWh", "Wh", "Wh", 2500},
+		{"29.92 inHg", "", "hPa", 1013.2},
+		{"1013.25", "hPa", "atm", 1},
+		{"36 km/h", "", "m/s", 10},
+		{"1e3 mW", "", "W", 1},
+		{"1.5 h", "", "min", 90},
+		{"-40", "F", "C", -40},
+	}
+
+	for _, c := range cases {
+		conversion := Conversion{Kind: "unit", From: c.from, To: c.to}
+		result, err := conversion.Convert(c.raw)
+		if err != nil {
+			t.Errorf("Converting %q to %v: %v", c.raw, c.to, err)
+			continue
+		}
+		if math.Abs(result.(float64)-c.expected) > 0.05 {
+			t.Errorf("Converting %q to %v: expected %v, got %v", c.raw, c.to, c.expected, result)
+		}
+	}
+
+	c := Conversion{Kind: "unit", From: "°C", To: "°F", Precision: 1}
+	checkConversion(c, map[string]interface{}{"21.5": 70.7, "100 °C": 212.0}, t)
+	checkExpectedErrors(c, []string{"", "warm", "21.5 kWh", "21.5 furlong"}, t)
+
+	c = Conversion{Kind: "unit", To: "°C"}
+	checkExpectedErrors(c, []string{"21.5"}, t)
+}
+
+func TestUnitTag(t *testing.T) {
+	s := &Subscription{
+		Measurement: "temperature",
+		Conversion:  Conversion{Kind: "unit", From: "°F", To: "°C", UnitTag: "unit"},
+	}
+	m, err := s.Read("foo/bar", "212")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m.Values["value"] != 100.0 {
+		t.Errorf("Expected 100, got %v", m.Values["value"])
+	}
+	if m.Tags["unit"] != "C" {
+		t.Errorf("Expected unit tag C, got %q", m.Tags["unit"])
+	}
+
+	invalid := []Conversion{
+		{Kind: "unit"},
+		{Kind: "unit", To: "parsec"},
+		{Kind: "unit", From: "kg", To: "m"},
+		{Kind: "unit", To: "m", UnitTag: "the unit"},
+	}
+	for _, c := range invalid {
+		s := &Subscription{Conversion: c}
+		if err := s.parseTemplates(); err == nil {
+			t.Errorf("Expected error for %+v, got OK", c)
+		}
+	}
+}